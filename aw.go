@@ -1,49 +1,250 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/codeation/inifile"
 )
 
 type node struct {
-	name string
-	ip   string
-	ipv6 string
+	name   string
+	ip     string
+	ipv6   string
+	vip    string // record content, when the node is behind a virtual IP
+	cname  string // CNAME record content, when the node is behind a host name
+	weight int
+	zone   string // failure domain, like a rack or an availability zone
+	group  string // node group, like a data center, a failover crosses groups when no node of the group is healthy
+	url    string // health check target of the node, the watch URL when blank
+	// selection order, a node with a lower number is preferred regardless of latency
+	priority int
+	// file to read the node weight from, so the weight may be changed without restart
+	weightFile string
+	// host name, the ip is resolved from every watch cycle, for a node with a dynamic IP
+	hostname string
+	// the host name is not resolved in the watch cycle, the ip is the last resolved one
+	lookupFailed bool
+	// planned maintenance, the node is never selected: "true" does not check the node, "probe" checks it
+	maintenance string
+	// SRV record name of the srv check, like _http._tcp.node.example.com
+	srv string
+}
+
+// Node weight read from the weight file
+type fileWeight struct {
+	weight int // 0 when the file is missing or invalid
+	read   time.Time
+}
+
+// weightFileCache is the time to keep the weight file content
+const weightFileCache = 10 * time.Second
+
+// target returns the IPv4 or CNAME record content of the node
+func (n *node) target() string {
+	if n.cname != "" {
+		return n.cname
+	}
+	if n.vip != "" {
+		return n.vip
+	}
+	return n.ip
+}
+
+// unresolved reports whether the host name of the node is not resolved in the watch cycle, the node is not checked.
+// The records still match the last resolved IP
+func (n *node) unresolved() bool {
+	return n.lookupFailed || n.hostname != "" && n.ip == ""
+}
+
+// addr returns the address the node is checked by, the IP or the CNAME host name
+func (n *node) addr() string {
+	if n.ip == "" {
+		return n.cname
+	}
+	return n.ip
+}
+
+// defaultWeight is the neutral node weight, a greater weight makes the node more preferable
+const defaultWeight = 100
+
+// Node check state between watch cycles
+type nodeState struct {
+	checked   bool          // node was checked at least once
+	up        bool          // node state, it changes after consecutive check results only
+	fails     int           // consecutive failed checks
+	rises     int           // consecutive passed checks
+	recovered time.Time     // node came back after a failure at
+	latency   time.Duration // moving average of passed check latencies, 0 when there is no history
+	history   history       // last check results, historysize long
+}
+
+// Node check result
+type checkResult struct {
+	ok       bool          // node is alive
+	draining bool          // node is alive, but sheds new traffic
+	status   int           // HTTP status code, 0 when there is no response
+	latency  time.Duration // response time
+	weight   int           // weight reported by the node, 0 when absent
+	node     string        // node name reported by the node
+}
+
+// Record switched recently, public DNS may still return the previous value
+type switched struct {
+	ip    string
+	until time.Time
+}
+
+// actual returns the switched IP while the record is settling, or the resolved IP otherwise
+func (s *switched) actual(resolved string) string {
+	if time.Now().Before(s.until) {
+		return s.ip
+	}
+	return resolved
 }
 
 type config struct {
-	ttl      time.Duration
-	domain   string
-	watchURL string
-	timeout  time.Duration
-	nodes    []node
-	cf       *cfConfig
+	debug         bool
+	ttl           time.Duration
+	domain        string // managed DNS name, its records are looked up and switched
+	watchURL      string // health check targets, comma separated, nodes are connected by IP
+	quorum        int    // passed checks of targets, the node is up with, 0 for the majority
+	roundRobin    bool   // records point to all healthy nodes
+	bootHealthy   bool   // do not start, when no node passes the startup probe
+	checkHost     string // health check host name, used for TLS handshake and Host header only
+	serverName    string // TLS handshake name instead of the URL host name, when set
+	noIPv6        bool   // AAAA records are not looked up and switched
+	source        string // actual records source
+	unknown       string // action, when the record points at an unknown IP
+	verifyRecord  bool   // check the record content besides the node IP
+	bootstrap     bool   // create the managed records, when no one exists at the first run
+	dryRun        bool   // log intended record changes without applying them
+	timeout       time.Duration
+	check         string // check mode
+	checkPort     string // TCP port of the tcp check
+	srvCheck      string // check of the SRV target, http or tcp
+	checkSend     []byte // request bytes of the tcp-expect check
+	checkExpect   []byte // response prefix of the tcp-expect check
+	keepAlive     bool   // reuse connections between checks
+	early         bool   // switch without checking all nodes
+	transports    map[string]http.RoundTripper
+	transportsMu  sync.Mutex // nodes are checked concurrently
+	recovery      time.Duration
+	dialTimeout   time.Duration // connect time limit of the check, within the timeout
+	failThreshold int           // consecutive failures, after which the node is down
+	riseThreshold int           // consecutive successes, after which the node is up
+	latencyAlpha  float64       // weight of the last latency in the moving average, 1 for no smoothing
+	domainBias    time.Duration // rank penalty of nodes in the failure domain of the failed node
+	settle        time.Duration // time to wait for cached DNS records after a switch
+	degraded      string        // least bad node criterion, when no node is healthy
+	failback      string        // policy, when a node of a lower priority than the acting node is healthy
+	failbackNoted string        // node of the last logged manual failback
+	selector      selector
+	weightHeader  string
+	listen        string       // HTTP listen address of the events endpoint
+	metrics       string       // HTTP listen address of the metrics endpoint
+	statusAddr    string       // HTTP listen address of the status endpoint
+	statusRecord  string       // TXT record name, the active node is published in
+	webhook       string       // URL to post record switches to
+	mail          *mailer      // nil when no mail is sent
+	nodeHeader    string       // response header, the node reports its name in
+	drainStatus   map[int]bool // status codes of a draining node
+	expectStatus  int          // status code of a healthy node
+	expectBody    string       // substring of the healthy node response body
+	checkMethod   string       // HTTP method of the check request
+	checkHeader   http.Header  // headers of the check request, Host sets the request host
+	checkAuthUser string       // Basic Auth user of the check request
+	checkAuthPass string       // Basic Auth password of the check request
+	checkBearer   string       // bearer token of the check request
+	active        string       // active file name
+	acting        string       // last line written to the active file
+	activeGroup   string       // group of the node the records point to, failover stays in the group
+	stateFile     string       // state file name
+	lastFailover  time.Time    // last successful switch of the records
+	nodes         []node
+	states        map[string]*nodeState
+	weights       map[string]fileWeight // by file name
+	switchedIP    switched
+	switchedIPv6  switched
+	dns           dnsProvider // DNS records of the domain
+	resolver      *net.Resolver
+	// round robin targets of the last cycle, nil before the first reconcile, and removal times by target
+	served   map[string]bool
+	removed  map[string]time.Time
+	cooldown time.Duration
+	// failover circuit breaker, a reload closes it
+	breaker breaker
+	// poll the resolver after a switch until the record is propagated
+	verifyPropagation   bool
+	propagationResolver *net.Resolver
+	propagationTimeout  time.Duration
+	// node checks of the cycle, shared by domains of the config file
+	checks *checkCache
+	// random shift of the watch cycle interval, up to the value either way
+	jitter time.Duration
+	// check results kept by node for the uptime, and watch cycles counted for the uptime log
+	historySize int
+	cycles      int
+	// last mailed switch outcome by record type, a switch, that fails every cycle, is mailed once
+	mailed map[string]string
+}
+
+// parseAddr parses the IP address, the IPv6 zone identifier like %eth0 is dropped
+func parseAddr(value string) net.IP {
+	if i := strings.IndexByte(value, '%'); i >= 0 {
+		value = value[:i]
+	}
+	return net.ParseIP(value)
 }
 
-// isAddrEqual compares two IP addresses
+// isAddrEqual compares two IP addresses, blank addresses are equal,
+// a malformed address is not equal to any address
 func isAddrEqual(left, right string) bool {
-	leftIP := net.ParseIP(left)
-	rightIP := net.ParseIP(right)
-	if rightIP == nil {
-		return leftIP == nil
+	if left == "" || right == "" {
+		return left == right
+	}
+	leftIP := parseAddr(left)
+	rightIP := parseAddr(right)
+	if leftIP == nil || rightIP == nil {
+		return false
 	}
 	return rightIP.Equal(leftIP)
 }
 
-func lookupProtocolDomain(protocol string, domain string) (string, error) {
-	ips, err := net.LookupIP(domain)
+// isContentEqual compares two record contents, IP addresses or host names
+func isContentEqual(left, right string) bool {
+	if parseAddr(left) != nil || parseAddr(right) != nil {
+		return isAddrEqual(left, right)
+	}
+	return strings.EqualFold(strings.TrimSuffix(left, "."), strings.TrimSuffix(right, "."))
+}
+
+func lookupProtocolDomain(ctx context.Context, resolver *net.Resolver, protocol string, domain string, skip []string) (string, error) {
+	ips, err := resolver.LookupIP(ctx, "ip", domain)
 	if err != nil {
 		return "", err
 	}
 	protocol = strings.ToLower(protocol)
 	for _, ip := range ips {
+		if isSkipped(ip.String(), skip) {
+			continue
+		}
 		switch protocol {
 		case "ipv4":
 			if ip.To4() != nil {
@@ -59,167 +260,1687 @@ func lookupProtocolDomain(protocol string, domain string) (string, error) {
 	return "", nil
 }
 
-// lookupDomain returns the IPv4 domains address
-func lookupDomain(domain string) (string, error) {
-	return lookupProtocolDomain("IPv4", domain)
+// isSkipped reports whether the IP address is in the list
+func isSkipped(ip string, skip []string) bool {
+	for _, s := range skip {
+		if isAddrEqual(ip, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupDomain returns the IPv4 domains address, except the skipped ones
+func lookupDomain(ctx context.Context, resolver *net.Resolver, domain string, skip ...string) (string, error) {
+	return lookupProtocolDomain(ctx, resolver, "IPv4", domain, skip)
 }
 
-// lookupDomain returns the IPv6 domains address
-func lookupDomainIPv6(domain string) (string, error) {
-	return lookupProtocolDomain("IPv6", domain)
+// lookupDomain returns the IPv6 domains address, except the skipped ones
+func lookupDomainIPv6(ctx context.Context, resolver *net.Resolver, domain string, skip ...string) (string, error) {
+	return lookupProtocolDomain(ctx, resolver, "IPv6", domain, skip)
 }
 
-func parseDuration(value string, defaultValue int, multiplier time.Duration) time.Duration {
+// parseDuration converts the value, a blank or zero value means the default value
+func parseDuration(value string, defaultValue int, multiplier time.Duration) (time.Duration, error) {
+	if value == "" {
+		return time.Duration(defaultValue) * multiplier, nil
+	}
 	n, err := strconv.Atoi(value)
-	if err != nil || n == 0 {
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
 		n = defaultValue
 	}
-	return time.Duration(n) * multiplier
+	return time.Duration(n) * multiplier, nil
+}
+
+// Duration settings reader, it keeps the first parse error
+type durationReader struct {
+	ini   iniFile
+	debug bool
+	err   error
+}
+
+func newDurationReader(ini iniFile) *durationReader {
+	return &durationReader{
+		ini:   ini,
+		debug: strings.ToLower(ini.Get("", "debug")) == "true",
+	}
+}
+
+// get returns the duration of the main section key
+func (d *durationReader) get(key string, defaultValue int, multiplier time.Duration) time.Duration {
+	value := d.ini.Get("", key)
+	if value == "" && d.debug {
+		log.Println("debug: " + key + " is missing, default " + strconv.Itoa(defaultValue) + " is used")
+	}
+	t, err := parseDuration(value, defaultValue, multiplier)
+	if err != nil && d.err == nil {
+		// typo like timeout=6o
+		d.err = errors.New(key + "=" + value + " is not a number")
+	}
+	return t
+}
+
+// apiTimeout returns the DNS provider API timeout, the cfapitimeout key is read, when apitimeout is missing
+func (d *durationReader) apiTimeout() time.Duration {
+	if d.ini.Get("", "apitimeout") == "" && d.ini.Get("", "cfapitimeout") != "" {
+		return d.get("cfapitimeout", 30, time.Second)
+	}
+	return d.get("apitimeout", 30, time.Second)
+}
+
+// defaultCooldown is the time after a record change, during which the record is not changed again
+const defaultCooldown = 10 * time.Minute
+
+// readCooldown returns the cooldown setting in seconds, unlike other durations 0 disables the cooldown
+func readCooldown(ini iniFile) (time.Duration, error) {
+	value := ini.Get("", "cooldown")
+	if value == "" {
+		return defaultCooldown, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, errors.New("cooldown=" + value + " is not a number")
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// parseWeight returns the node weight, or 0 when the value is absent or out of bounds
+func parseWeight(value string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n < 1 || n > 1000 {
+		return 0
+	}
+	return n
+}
+
+// readHeaders returns headers of the check request, names are listed by checkheaders,
+// values are read by header.<name> keys
+func readHeaders(ini iniFile) http.Header {
+	header := http.Header{}
+	for _, name := range strings.Split(ini.Get("", "checkheaders"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			header.Set(name, ini.Get("", "header."+name))
+		}
+	}
+	return header
+}
+
+// configName returns the config file name: the flag value, the argument,
+// the AW_CONFIG environment variable or aw.ini in the working directory
+func configName(flagValue, arg string) string {
+	for _, name := range []string{flagValue, arg, os.Getenv("AW_CONFIG")} {
+		if name != "" {
+			return name
+		}
+	}
+	return "aw.ini"
+}
+
+// isRemoteConfig reports whether the config is fetched by the HTTP URL
+func isRemoteConfig(filename string) bool {
+	return strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://")
+}
+
+// readConfig reads the ini file, "-" reads the standard input, an HTTP URL is fetched
+func readConfig(filename string) (*inifile.IniFile, error) {
+	if filename == "-" {
+		return readConfigFrom(os.Stdin)
+	}
+	if isRemoteConfig(filename) {
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Get(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New("config " + filename + " fetch failed, status " + strconv.Itoa(resp.StatusCode))
+		}
+		return readConfigFrom(resp.Body)
+	}
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil, errors.New("config file " + filename + " does not exist")
+	}
+	return inifile.Read(filename)
+}
+
+// Settings of the parsed config, the ini file has the main section "" and a section per node
+type iniFile interface {
+	Get(section, key string) string
+	Sections() []string
+	Command(on bool)
+}
+
+// readConfigFrom reads the ini of the reader, the ini is parsed from a private temporary file
+func readConfigFrom(r io.Reader) (*inifile.IniFile, error) {
+	tmp, err := ioutil.TempFile("", "aw-*.ini")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	return inifile.Read(tmp.Name())
 }
 
-func loadConfig(filename string) (*config, error) {
-	ini, err := inifile.Read(filename)
+// loadConfig returns configs of the domains, the managed records of each domain are switched separately
+func loadConfig(filename string) ([]*config, error) {
+	ini, err := readConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := logOutput.configure(ini); err != nil {
+		return nil, err
+	}
+	cfgs, err := parseConfig(ini)
 	if err != nil {
 		return nil, err
 	}
+	for _, cfg := range cfgs {
+		if cfg.check == "ping" {
+			// the platform or permissions may not allow raw sockets
+			conn, err := listenICMP()
+			if err != nil {
+				return nil, err
+			}
+			conn.Close()
+		}
+		cfg.loadState()
+	}
+	return cfgs, nil
+}
+
+// parseConfig returns configs of the domains of the parsed ini, no file is read or written
+func parseConfig(ini iniFile) ([]*config, error) {
 	if strings.ToLower(ini.Get("", "command")) == "true" {
 		ini.Command(true)
 	}
+	domains := splitDomains(ini.Get("", "domain"))
+	checks := &checkCache{}
+	var cfgs []*config
+	for i, domain := range domains {
+		cfg, err := newConfig(ini, domain)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			// files of the first domain keep their names
+			cfg.active = domainFile(cfg.active, domain)
+			cfg.stateFile = domainFile(cfg.stateFile, domain)
+		}
+		// nodes are checked once a cycle for all domains
+		cfg.checks = checks
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, nil
+}
+
+// newConfig reads the config of the domain, names of the domain are read by the names.<domain> key
+func newConfig(ini iniFile, domain string) (*config, error) {
+	d := newDurationReader(ini)
+	// public resolvers cache a switched record for its TTL, TTL 1 is the CloudFlare automatic TTL of 300 seconds
+	settle := 300
+	if ttl, err := parseDuration(ini.Get("", "recordttl"), 0, time.Second); err == nil && ttl > time.Second {
+		// an invalid recordttl is reported by the provider
+		settle = int(ttl / time.Second)
+	}
 	cfg := &config{
-		ttl:      parseDuration(ini.Get("", "ttl"), 60, time.Second),
-		domain:   ini.Get("", "domain"),
-		watchURL: ini.Get("", "url"),
-		timeout:  parseDuration(ini.Get("", "timeout"), 60, time.Second),
+		debug:        d.debug,
+		ttl:          d.get("ttl", 60, time.Second),
+		jitter:       d.get("jitter", 0, time.Second),
+		domain:       domain,
+		watchURL:     ini.Get("", "url"),
+		source:       strings.ToLower(ini.Get("", "source")),
+		unknown:      strings.ToLower(ini.Get("", "unknown")),
+		verifyRecord: strings.ToLower(ini.Get("", "verifyrecord")) == "true",
+		bootstrap:    strings.ToLower(ini.Get("", "bootstrap")) == "true",
+		dryRun:       strings.ToLower(ini.Get("", "dryrun")) == "true",
+		timeout:      d.get("timeout", 60, time.Second),
+		check:        strings.ToLower(ini.Get("", "check")),
+		checkPort:    ini.Get("", "checkport"),
+		checkSend:    parseEscaped(ini.Get("", "checksend")),
+		checkExpect:  parseEscaped(ini.Get("", "checkexpect")),
+		keepAlive:    strings.ToLower(ini.Get("", "keepalive")) == "true",
+		early:        strings.ToLower(ini.Get("", "early")) == "true",
+		transports:   map[string]http.RoundTripper{},
+		recovery:     d.get("recovery", 0, time.Second),
+		domainBias:   d.get("domainbias", 0, time.Millisecond),
+		settle:       d.get("settle", settle, time.Second),
+		degraded:     strings.ToLower(ini.Get("", "degraded")),
+		failback:     strings.ToLower(ini.Get("", "failback")),
+		weightHeader: ini.Get("", "weightheader"),
+		listen:       ini.Get("", "listen"),
+		metrics:      ini.Get("", "metrics"),
+		statusAddr:   ini.Get("", "statusaddr"),
+		statusRecord: ini.Get("", "statusrecord"),
+		webhook:      ini.Get("", "webhook"),
+		nodeHeader:   ini.Get("", "nodeheader"),
+		active:       ini.Get("", "activefile"),
+		stateFile:    ini.Get("", "statefile"),
+		drainStatus:  map[int]bool{},
+		expectStatus: http.StatusOK,
+		expectBody:   ini.Get("", "expectbody"),
+		checkMethod:  strings.ToUpper(ini.Get("", "checkmethod")),
+		checkHeader:  readHeaders(ini),
+		checkBearer:  ini.Get("", "checkbearer"),
+		states:       map[string]*nodeState{},
+		weights:      map[string]fileWeight{},
+		mailed:       map[string]string{},
+	}
+	cfg.verifyPropagation = strings.ToLower(ini.Get("", "verifypropagation")) == "true"
+	cfg.resolver = newResolver(ini.Get("", "resolver"))
+	cfg.propagationResolver = cfg.resolver
+	if address := ini.Get("", "verifyresolver"); address != "" {
+		cfg.propagationResolver = newResolver(address)
+	}
+	cfg.propagationTimeout = d.get("propagationtimeout", 60, time.Second)
+	cfg.breaker.window = d.get("failoverwindow", 3600, time.Second)
+	cfg.breaker.wait = d.get("breakerwait", int(cfg.breaker.window/time.Second), time.Second)
+	cfg.dialTimeout = d.get("connecttimeout", 0, time.Second)
+	if d.err != nil {
+		return nil, d.err
+	}
+	if cfg.domainBias == 0 {
+		// the node in the other failure domain is preferred over any node in the same domain
+		cfg.domainBias = cfg.timeout
+	}
+	if value := ini.Get("", "expectstatus"); value != "" {
+		code, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.New("expectstatus=" + value + " is not a status code")
+		}
+		cfg.expectStatus = code
+	}
+	if cfg.dialTimeout == 0 || cfg.dialTimeout > cfg.timeout {
+		cfg.dialTimeout = cfg.timeout
+	}
+	cfg.failThreshold = 3
+	if value := ini.Get("", "failthreshold"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, errors.New("failthreshold=" + value + " is not a number")
+		}
+		cfg.failThreshold = n
+	}
+	if value := ini.Get("", "maxfailovers"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, errors.New("maxfailovers=" + value + " is not a number")
+		}
+		cfg.breaker.max = n
+	}
+	if value := ini.Get("", "historysize"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, errors.New("historysize=" + value + " is not a number")
+		}
+		cfg.historySize = n
+	}
+	cfg.riseThreshold = 1
+	if value := ini.Get("", "risethreshold"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, errors.New("risethreshold=" + value + " is not a number")
+		}
+		cfg.riseThreshold = n
+	}
+	cfg.latencyAlpha = 1
+	if value := ini.Get("", "latencyalpha"); value != "" {
+		alpha, err := strconv.ParseFloat(value, 64)
+		if err != nil || alpha <= 0 || alpha > 1 {
+			return nil, errors.New("latencyalpha=" + value + " is not a number from 0 to 1")
+		}
+		cfg.latencyAlpha = alpha
+	}
+	for _, value := range strings.Split(ini.Get("", "drainstatus"), ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		code, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.New("drainstatus=" + value + " is not a status code")
+		}
+		cfg.drainStatus[code] = true
+	}
+	if value := ini.Get("", "quorum"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, errors.New("quorum=" + value + " is not a number")
+		}
+		cfg.quorum = n
+	}
+	// the first target names the checked host
+	u, err := url.Parse(strings.TrimSpace(strings.Split(cfg.watchURL, ",")[0]))
+	if err != nil {
+		return nil, err
+	}
+	cfg.checkHost = u.Hostname()
+	cfg.serverName = ini.Get("", "servername")
+	cfg.noIPv6 = strings.ToLower(ini.Get("", "ipv6")) == "false"
+	cfg.bootHealthy = strings.ToLower(ini.Get("", "requirehealthyboot")) == "true"
+	if net.ParseIP(cfg.checkHost) != nil && cfg.serverName == "" {
+		// certificates are issued for names
+		log.Println("Health check host " + cfg.checkHost + " is an IP address, set servername to the certificate name")
+	}
+	if cfg.checkHost != cfg.domain && !strings.HasSuffix(cfg.checkHost, "."+cfg.domain) {
+		log.Println("Health check host " + cfg.checkHost + " differs from managed domain " + cfg.domain)
+	}
+	if cfg.source != "" && cfg.source != "dns" && cfg.source != "cloudflare" {
+		return nil, errors.New("unknown source " + cfg.source)
+	}
+	if cfg.unknown != "" && cfg.unknown != "takeover" && cfg.unknown != "hold" && cfg.unknown != "confirm" {
+		return nil, errors.New("unknown action " + cfg.unknown)
+	}
+	if cfg.failback != "" && cfg.failback != "sticky" && cfg.failback != "manual" && cfg.failback != "auto" {
+		return nil, errors.New("unknown failback " + cfg.failback)
+	}
+	if cfg.degraded != "" && cfg.degraded != "latency" && cfg.degraded != "status" {
+		return nil, errors.New("unknown degraded " + cfg.degraded)
+	}
+	switch mode := strings.ToLower(ini.Get("", "mode")); mode {
+	case "", "failover":
+	case "roundrobin":
+		if cfg.early {
+			return nil, errors.New("mode=roundrobin checks all nodes, early is not allowed")
+		}
+		cfg.roundRobin = true
+		cfg.removed = map[string]time.Time{}
+		if cfg.cooldown, err = readCooldown(ini); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unknown mode " + mode)
+	}
+	selectorName := strings.ToLower(ini.Get("", "selector"))
+	if selectorName == "" {
+		selectorName = "fastest"
+	}
+	var ok bool
+	if cfg.selector, ok = selectors[selectorName]; !ok {
+		return nil, errors.New("unknown selector " + selectorName)
+	}
+	cfg.checkAuthUser = ini.Get("", "checkauthuser")
+	cfg.checkAuthPass = ini.Get("", "checkauthpass")
+	if cfg.checkAuthUser != "" && cfg.checkBearer != "" {
+		return nil, errors.New("checkauthuser and checkbearer are exclusive, set one of them")
+	}
+	switch cfg.checkMethod {
+	case "":
+		cfg.checkMethod = "GET"
+	case "GET":
+	case "HEAD":
+		if cfg.expectBody != "" {
+			return nil, errors.New("checkmethod=HEAD gets no response body, expectbody is not allowed")
+		}
+	default:
+		return nil, errors.New("unknown checkmethod " + cfg.checkMethod)
+	}
+	switch cfg.check {
+	case "", "http":
+	case "http3":
+		if !http3Supported {
+			return nil, errors.New("check=http3 is not supported by this build, rebuild with -tags http3")
+		}
+	case "tcp":
+		if cfg.checkPort == "" {
+			return nil, errors.New("check=tcp needs checkport")
+		}
+	case "tcp-expect":
+		if cfg.checkPort == "" || len(cfg.checkExpect) == 0 {
+			return nil, errors.New("check=tcp-expect needs checkport and checkexpect")
+		}
+	case "srv":
+		// other checks of a record IP have no SRV record
+		if cfg.verifyRecord || cfg.unknown == "confirm" {
+			return nil, errors.New("check=srv does not allow verifyrecord and unknown=confirm")
+		}
+		switch cfg.srvCheck = strings.ToLower(ini.Get("", "srvcheck")); cfg.srvCheck {
+		case "":
+			cfg.srvCheck = "http"
+		case "http", "tcp":
+		default:
+			return nil, errors.New("unknown srvcheck " + cfg.srvCheck)
+		}
+	case "ping":
+		// the raw socket is probed by loadConfig
+	default:
+		return nil, errors.New("unknown check mode " + cfg.check)
 	}
 	for _, name := range ini.Sections() {
+		weight := parseWeight(ini.Get(name, "weight"))
+		if weight == 0 {
+			weight = defaultWeight
+		}
+		priority := 0
+		if value := ini.Get(name, "priority"); value != "" {
+			if priority, err = strconv.Atoi(value); err != nil {
+				return nil, errors.New("node " + name + ": priority=" + value + " is not a number")
+			}
+		}
+		maintenance := strings.ToLower(ini.Get(name, "maintenance"))
+		switch maintenance {
+		case "false":
+			maintenance = ""
+		case "", "true", "probe":
+		default:
+			return nil, errors.New("node " + name + ": unknown maintenance " + maintenance)
+		}
+		ipv6 := ini.Get(name, "ipv6")
+		if cfg.noIPv6 {
+			// no node has AAAA records, so IPv6 is never switched
+			ipv6 = ""
+		}
 		cfg.nodes = append(cfg.nodes, node{
-			name: name,
-			ip:   ini.Get(name, "ip"),
-			ipv6: ini.Get(name, "ipv6"),
+			name:        name,
+			ip:          ini.Get(name, "ip"),
+			ipv6:        ipv6,
+			vip:         ini.Get(name, "vip"),
+			cname:       ini.Get(name, "cname"),
+			weight:      weight,
+			priority:    priority,
+			zone:        ini.Get(name, "domain"),
+			group:       ini.Get(name, "group"),
+			weightFile:  ini.Get(name, "weightfile"),
+			url:         ini.Get(name, "url"),
+			hostname:    ini.Get(name, "hostname"),
+			srv:         ini.Get(name, "srv"),
+			maintenance: maintenance,
 		})
 	}
-	cfg.cf = newCFConfig(ini)
+	if cfg.mail, err = newMailer(ini); err != nil {
+		return nil, err
+	}
+	names := ini.Get("", "names."+domain)
+	if names == "" {
+		names = ini.Get("", "names")
+	}
+	cfg.dns, err = newProvider(ini, domain, strings.Split(names, ","))
+	if err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
-func (cfg *config) checkNode(ip string) (bool, time.Duration) {
+// validate returns all problems of the required settings joined, or nil
+func (cfg *config) validate() error {
+	var problems []error
+	if cfg.domain == "" {
+		problems = append(problems, errors.New("domain is not set"))
+	}
+	if cfg.watchURL == "" {
+		problems = append(problems, errors.New("url is not set"))
+	}
+	for _, rawURL := range splitURLs(cfg.watchURL) {
+		if u, err := url.Parse(rawURL); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, errors.New("url "+rawURL+" is not an absolute URL"))
+		}
+	}
+	if len(cfg.nodes) == 0 {
+		problems = append(problems, errors.New("no node section found"))
+	}
+	for _, n := range cfg.nodes {
+		if n.ip == "" && n.cname == "" && n.hostname == "" {
+			problems = append(problems, errors.New("node "+n.name+": ip is not set"))
+		}
+		if cfg.check == "srv" && n.srv == "" {
+			problems = append(problems, errors.New("node "+n.name+": check=srv needs srv"))
+		}
+		if cfg.check == "ping" && n.ip == "" && n.hostname == "" {
+			problems = append(problems, errors.New("node "+n.name+": check=ping needs the ip"))
+		}
+		if n.hostname != "" && (n.ip != "" || n.cname != "") {
+			problems = append(problems, errors.New("node "+n.name+": hostname excludes ip and cname"))
+		}
+		if n.cname != "" {
+			if n.vip != "" || n.ipv6 != "" {
+				problems = append(problems, errors.New("node "+n.name+": cname excludes vip and ipv6"))
+			}
+			if _, ok := cfg.dns.(*cfConfig); !ok {
+				problems = append(problems, errors.New("node "+n.name+": cname is supported by the CloudFlare provider only"))
+			}
+			if cfg.roundRobin {
+				problems = append(problems, errors.New("node "+n.name+": cname is not allowed with mode=roundrobin"))
+			}
+			if cfg.source != "cloudflare" {
+				// public DNS returns addresses of the host name, or of the flattened CNAME
+				problems = append(problems, errors.New("node "+n.name+": cname needs source=cloudflare"))
+			}
+		}
+		for _, addr := range [][2]string{{"ip", n.ip}, {"ipv6", n.ipv6}, {"vip", n.vip}} {
+			if addr[1] != "" && net.ParseIP(addr[1]) == nil {
+				problems = append(problems, errors.New("node "+n.name+": "+addr[0]+" "+addr[1]+" is not an IP address"))
+			}
+		}
+		// a copy-paste error writes the address to the record of the other type
+		if ip := net.ParseIP(n.ip); ip != nil && ip.To4() == nil {
+			log.Println("WARNING: node " + n.name + ": ip " + n.ip + " is not an IPv4 address")
+		}
+		if ip := net.ParseIP(n.ipv6); ip != nil && ip.To4() != nil {
+			log.Println("WARNING: node " + n.name + ": ipv6 " + n.ipv6 + " is not an IPv6 address")
+		}
+		for _, rawURL := range splitURLs(n.url) {
+			if u, err := url.Parse(rawURL); err != nil || u.Scheme == "" || u.Host == "" {
+				problems = append(problems, errors.New("node "+n.name+": url "+rawURL+" is not an absolute URL"))
+			}
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// newTLSTransport returns the transport connecting to the node IP, by TLS for an https URL
+// and by plain TCP for an http URL
+func newTLSTransport(ip, serverName string, keepAlive bool, dialTimeout time.Duration) http.RoundTripper {
+	return &http.Transport{
+		DisableKeepAlives: !keepAlive,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			// connect via IP, not the DNS name
+			d := net.Dialer{Timeout: dialTimeout}
+			conn, err := d.DialContext(ctx, network, ip+":"+port)
+			if err != nil {
+				return nil, &connectError{err: err}
+			}
+			return conn, nil
+		},
+		DialTLSContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			if serverName != "" {
+				host = serverName
+			}
+			// connect via IP, not the DNS name
+			conn, err := (&net.Dialer{Timeout: dialTimeout}).DialContext(ctx, network, ip+":"+port)
+			if err != nil {
+				return nil, &connectError{err: err}
+			}
+			// use the DNS name for the handshake
+			tlsConn := tls.Client(conn, &tls.Config{
+				ServerName: host,
+			})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+	}
+}
+
+// Connection error of the check, the node is not reached
+type connectError struct {
+	err error
+}
+
+func (e *connectError) Error() string {
+	return "connect: " + e.err.Error()
+}
+
+func (e *connectError) Unwrap() error {
+	return e.err
+}
+
+// checkPhase returns the check phase, that exceeded the time limit, or blank for another error
+func checkPhase(err error) string {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return ""
+	}
+	var connErr *connectError
+	if errors.As(err, &connErr) {
+		return "connect"
+	}
+	return "response"
+}
+
+// tlsTransport returns the node transport, the transport is reused when keep-alive is on,
+// otherwise every check makes a fresh connection
+func (cfg *config) tlsTransport(ip string) http.RoundTripper {
+	if !cfg.keepAlive {
+		return newTLSTransport(ip, cfg.serverName, false, cfg.dialTimeout)
+	}
+	cfg.transportsMu.Lock()
+	defer cfg.transportsMu.Unlock()
+	transport, ok := cfg.transports[ip]
+	if !ok {
+		transport = newTLSTransport(ip, cfg.serverName, true, cfg.dialTimeout)
+		cfg.transports[ip] = transport
+	}
+	return transport
+}
+
+// nodeURL returns the health check target of the node
+func (cfg *config) nodeURL(n *node) string {
+	if n.url != "" {
+		return n.url
+	}
+	return cfg.watchURL
+}
+
+// checkNode checks the node IP by the check mode, the URL is the target of HTTP checks,
+// a comma separated list of URLs are targets of the quorum check
+func (cfg *config) checkNode(ctx context.Context, ip string, rawURL string) checkResult {
+	switch cfg.check {
+	case "tcp":
+		return cfg.checkTCP(ctx, ip)
+	case "tcp-expect":
+		return cfg.checkTCPExpect(ctx, ip)
+	case "ping":
+		return cfg.checkPing(ctx, ip)
+	}
+	if urls := splitURLs(rawURL); len(urls) > 1 {
+		return cfg.checkQuorum(ctx, ip, urls)
+	}
+	return cfg.checkHTTP(ctx, ip, strings.TrimSpace(rawURL))
+}
+
+// maxCheckBody is the maximum size of the check response body to read
+const maxCheckBody = 1 << 20
+
+// checkHTTP gets the URL from the node IP, the URL host name is used for the TLS handshake
+func (cfg *config) checkHTTP(ctx context.Context, ip string, rawURL string) checkResult {
 	t0 := time.Now()
+	var transport http.RoundTripper
+	switch cfg.check {
+	case "http3":
+		transport = newHTTP3Transport(ip, cfg.serverName)
+	default:
+		transport = cfg.tlsTransport(ip)
+	}
+	if c, ok := transport.(io.Closer); ok {
+		// QUIC transport holds an UDP socket
+		defer c.Close()
+	}
 	client := &http.Client{
-		Timeout: cfg.timeout,
-		Transport: &http.Transport{
-			DialTLS: func(network string, addr string) (net.Conn, error) {
-				host, port, err := net.SplitHostPort(addr)
-				if err != nil {
-					return nil, err
-				}
-				// use the DNS name for the handshake
-				c := &tls.Config{
-					ServerName: host,
-				}
-				// connect via IP, not the DNS name
-				return tls.Dial(network, ip+":"+port, c)
-			},
-		},
+		Timeout:   cfg.timeout,
+		Transport: transport,
 	}
-	req, err := http.NewRequest("GET", cfg.watchURL, nil)
+	req, err := http.NewRequestWithContext(ctx, cfg.checkMethod, rawURL, nil)
 	if err != nil {
 		// bad URL, log it
 		log.Println(err)
-		return false, 0
+		return checkResult{}
+	}
+	for key, values := range cfg.checkHeader {
+		if key == "Host" {
+			// Go sends the request host instead of the header
+			req.Host = values[0]
+			continue
+		}
+		req.Header[key] = values
+	}
+	if cfg.checkAuthUser != "" {
+		req.SetBasicAuth(cfg.checkAuthUser, cfg.checkAuthPass)
+	} else if cfg.checkBearer != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.checkBearer)
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		// timeout or other connection error, keep silent
-		return false, 0
+		if phase := checkPhase(err); phase != "" {
+			// the node is not reachable or the application is slow
+			log.Println("Check " + ip + ": " + phase + " timeout")
+		}
+		// other connection errors are silent
+		return checkResult{}
 	}
 	defer resp.Body.Close()
+	// the latency includes the body read
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+	if err != nil {
+		return checkResult{}
+	}
 	// node is alive
-	return resp.StatusCode == http.StatusOK, time.Since(t0)
+	res := checkResult{
+		ok:       resp.StatusCode == cfg.expectStatus && strings.Contains(string(body), cfg.expectBody),
+		draining: cfg.drainStatus[resp.StatusCode],
+		status:   resp.StatusCode,
+		latency:  time.Since(t0),
+	}
+	if cfg.weightHeader != "" {
+		// the node may report its own weight
+		res.weight = parseWeight(resp.Header.Get(cfg.weightHeader))
+	}
+	if cfg.nodeHeader != "" {
+		res.node = resp.Header.Get(cfg.nodeHeader)
+	}
+	return res
 }
 
-func (cfg *config) watch() {
-	// actual DNS records
-	actualIP, err := lookupDomain(cfg.domain)
+// readWeight returns the node weight from the weight file, or 0 when the file is missing or invalid
+func (cfg *config) readWeight(n *node) int {
+	if n.weightFile == "" {
+		return 0
+	}
+	w, ok := cfg.weights[n.weightFile]
+	if !ok || time.Since(w.read) >= weightFileCache {
+		w = fileWeight{read: time.Now()}
+		if data, err := ioutil.ReadFile(n.weightFile); err == nil {
+			w.weight = parseWeight(string(data))
+		}
+		cfg.weights[n.weightFile] = w
+	}
+	return w.weight
+}
+
+// updateState saves the node check result and returns the node state and true while the node is recovering.
+// The node is down after failthreshold consecutive failures and up after risethreshold consecutive successes
+func (cfg *config) updateState(name string, ok bool) (bool, bool) {
+	s := cfg.stateOf(name)
+	if cfg.historySize > 0 {
+		s.history.add(ok, cfg.historySize)
+	}
+	if ok {
+		s.rises++
+		s.fails = 0
+	} else {
+		s.fails++
+		s.rises = 0
+	}
+	up := s.up
+	switch {
+	case !s.checked:
+		// no history yet
+		up = ok
+	case s.up && s.fails >= cfg.failThreshold:
+		up = false
+	case !s.up && s.rises >= cfg.riseThreshold:
+		up = true
+	}
+	now := time.Now()
+	if s.checked && s.up != up {
+		if up {
+			notify("state", name, name+" is up")
+			cfg.reportRecovery(name)
+		} else {
+			notify("state", name, name+" is down")
+			cfg.mail.send("aw: "+name+" is down", name+" is down since "+now.Format(time.RFC1123Z))
+		}
+	}
+	if up && s.checked && !s.up && cfg.recovery > 0 {
+		// node is alive again, but may still be warming up
+		s.recovered = now
+		notify("state", name, name+" recovered, penalty until "+now.Add(cfg.recovery).Format("15:04:05"))
+	}
+	if !up {
+		s.recovered = time.Time{}
+	}
+	if !s.recovered.IsZero() && now.Sub(s.recovered) >= cfg.recovery {
+		notify("state", name, name+" recovery penalty expired")
+		s.recovered = time.Time{}
+	}
+	s.checked = true
+	s.up = up
+	return up, !s.recovered.IsZero()
+}
+
+// stateOf returns the node state, a blank state is saved for a node, that was never checked
+func (cfg *config) stateOf(name string) *nodeState {
+	s, found := cfg.states[name]
+	if !found {
+		s = &nodeState{}
+		cfg.states[name] = s
+	}
+	return s
+}
+
+// drainState returns the node state and true while the node is recovering.
+// A draining node is alive, so its consecutive check counters are not changed
+func (cfg *config) drainState(name string) (bool, bool) {
+	s := cfg.stateOf(name)
+	return s.up, !s.recovered.IsZero()
+}
+
+// writeActive saves the acting node name and IP to the active file
+func (cfg *config) writeActive(name, ip string) {
+	line := name + " " + ip + "\n"
+	if cfg.active == "" || line == cfg.acting {
+		return
+	}
+	// write a temporary file and rename it, so readers never get a partial line
+	tmp := cfg.active + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(line), 0644); err != nil {
+		log.Println(err)
+		return
+	}
+	if err := os.Rename(tmp, cfg.active); err != nil {
+		log.Println(err)
+		return
+	}
+	cfg.acting = line
+}
+
+// lessDegraded reports whether the failed check a is closer to healthy than b
+func (cfg *config) lessDegraded(a, b checkResult) bool {
+	if cfg.degraded == "status" {
+		da := a.status - cfg.expectStatus
+		if da < 0 {
+			da = -da
+		}
+		db := b.status - cfg.expectStatus
+		if db < 0 {
+			db = -db
+		}
+		if da != db {
+			return da < db
+		}
+	}
+	return a.latency < b.latency
+}
+
+// resolveNodes sets IPs of nodes with a host name, a node, that is not resolved, is skipped in the cycle
+func (cfg *config) resolveNodes(ctx context.Context) {
+	for i := range cfg.nodes {
+		n := &cfg.nodes[i]
+		if n.hostname == "" {
+			continue
+		}
+		ip, err := lookupDomain(ctx, cfg.resolver, n.hostname)
+		if err != nil {
+			log.Println("WARNING: node " + n.name + ": hostname " + n.hostname + " is not resolved, the node is skipped: " + err.Error())
+			// the acting node is still found by the last resolved IP
+			n.lookupFailed = true
+			continue
+		}
+		n.lookupFailed = false
+		if n.ip != "" && n.ip != ip {
+			log.Println("Node " + n.name + " IP changed from " + n.ip + " to " + ip)
+		}
+		n.ip = ip
+	}
+}
+
+// probeNodes checks every node once, logs a warning for every failed node and returns the number of healthy nodes.
+// The node state is not changed, a failed node may come up later
+func (cfg *config) probeNodes(ctx context.Context) int {
+	cfg.resolveNodes(ctx)
+	results := make([]checkResult, len(cfg.nodes))
+	var wg sync.WaitGroup
+	for i := range cfg.nodes {
+		if cfg.nodes[i].maintenance != "" || cfg.nodes[i].unresolved() {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = cfg.checkShared(ctx, &cfg.nodes[i])
+		}(i)
+	}
+	wg.Wait()
+	healthy := 0
+	for i, res := range results {
+		n := &cfg.nodes[i]
+		if n.maintenance != "" || n.unresolved() {
+			// the node is not selected anyway, an unresolved node is logged by resolveNodes
+			continue
+		}
+		if res.ok {
+			healthy++
+			continue
+		}
+		if res.status != 0 {
+			log.Println("WARNING: node " + n.name + " (" + n.addr() + ") fails the startup check, status " + strconv.Itoa(res.status))
+		} else {
+			log.Println("WARNING: node " + n.name + " (" + n.addr() + ") is unreachable at startup")
+		}
+	}
+	return healthy
+}
+
+// checkNodes checks all nodes concurrently within the timeout, results are indexed by the node position.
+// In early decision mode nodes are checked one by one, each within its own timeout, the acting node first,
+// the checks stop, once the acting node is down and a healthy node is found, results of unchecked nodes are nil
+func (cfg *config) checkNodes(ctx context.Context, acting int) []*checkResult {
+	results := make([]*checkResult, len(cfg.nodes))
+	if !cfg.early {
+		// a slow node does not delay checks of other nodes
+		ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+		defer cancel()
+		var wg sync.WaitGroup
+		for i := range cfg.nodes {
+			if cfg.nodes[i].maintenance == "true" || cfg.nodes[i].unresolved() {
+				continue
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				res := cfg.checkShared(ctx, &cfg.nodes[i])
+				results[i] = &res
+			}(i)
+		}
+		wg.Wait()
+		return results
+	}
+	order := make([]int, 0, len(cfg.nodes))
+	for i := range cfg.nodes {
+		if i == acting {
+			order = append([]int{i}, order...)
+		} else {
+			order = append(order, i)
+		}
+	}
+	actingDown := true
+	for _, i := range order {
+		if cfg.nodes[i].maintenance == "true" || cfg.nodes[i].unresolved() {
+			continue
+		}
+		// a hung node does not leave the next nodes without time
+		checkCtx, cancel := context.WithTimeout(ctx, cfg.timeout)
+		res := cfg.checkShared(checkCtx, &cfg.nodes[i])
+		cancel()
+		results[i] = &res
+		// a node in maintenance or a draining node is not selected, the check goes on
+		selectable := res.ok && !res.draining && cfg.nodes[i].maintenance == ""
+		if i == acting && selectable {
+			actingDown = false
+		}
+		if actingDown && selectable {
+			break
+		}
+	}
+	return results
+}
+
+// lookupActual returns the actual IPv4 and IPv6 domain addresses
+func (cfg *config) lookupActual(ctx context.Context) (string, string, error) {
+	if cfg.source == "cloudflare" {
+		// public DNS is not CloudFlare authoritative
+		return cfg.dns.actualRecords(ctx)
+	}
+	// pinned records are not failover targets
+	pinned := cfg.dns.pinnedContents("@")
+	actualIP, err := lookupDomain(ctx, cfg.resolver, cfg.domain, pinned...)
 	if err != nil {
-		log.Println("DNS lookup failure")
+		return "", "", errors.New("DNS lookup failure")
+	}
+	if cfg.noIPv6 {
+		return actualIP, "", nil
+	}
+	actualIPv6, _ := lookupDomainIPv6(ctx, cfg.resolver, cfg.domain, pinned...) // ignore errors
+	return actualIP, actualIPv6, nil
+}
+
+// logRecords writes the managed records to the debug log
+func (cfg *config) logRecords(ctx context.Context) {
+	lines, err := cfg.dns.describeRecords(ctx)
+	if err != nil {
+		log.Println("debug: records are not read: " + err.Error())
 		return
 	}
-	actualIPv6, _ := lookupDomainIPv6(cfg.domain) // ignore errors
-	// active node IPs
-	selectedIPv6 := ""
-	selectedNode := ""
-	// fastest node IPs
-	minIP := ""
-	minIPv6 := ""
-	minNode := ""
-	minTimeout := cfg.timeout
+	for _, line := range lines {
+		log.Println("debug: record " + line)
+	}
+}
+
+// actingNode returns the index of the node the actual IP belongs to, or -1 for an unknown IP.
+// When nodes share the virtual IP, the node behind the virtual IP reports its name in the node header
+func (cfg *config) actingNode(ctx context.Context, actualIP string) int {
+	var found []int
+	for i := range cfg.nodes {
+		// a node, that was never resolved, has no target
+		if target := cfg.nodes[i].target(); target != "" && isContentEqual(target, actualIP) {
+			found = append(found, i)
+		}
+	}
+	if len(found) == 0 {
+		return -1
+	}
+	if len(found) > 1 && cfg.nodeHeader != "" {
+		res := cfg.checkNode(ctx, actualIP, cfg.watchURL)
+		for _, i := range found {
+			if cfg.nodes[i].name == res.node {
+				return i
+			}
+		}
+	}
+	return found[0]
+}
+
+// smoothLatency adds the passed check latency to the node moving average and returns the average.
+// The first measurement starts the average
+func (cfg *config) smoothLatency(name string, latency time.Duration) time.Duration {
+	s := cfg.states[name]
+	if s.latency == 0 {
+		s.latency = latency
+	} else {
+		s.latency = time.Duration(cfg.latencyAlpha*float64(latency) + (1-cfg.latencyAlpha)*float64(s.latency))
+	}
+	return s.latency
+}
+
+// rank returns the node response time scaled by the node weight
+func (cfg *config) rank(n *node, res checkResult) time.Duration {
+	weight := n.weight
+	if w := cfg.readWeight(n); w != 0 {
+		weight = w
+	}
+	if res.weight != 0 {
+		weight = res.weight
+	}
+	return res.latency * defaultWeight / time.Duration(weight)
+}
+
+// bootstrapZone creates the managed records pointing at the best healthy node, when no managed record exists.
+// It reports whether the records are created
+func (cfg *config) bootstrapZone(ctx context.Context) (bool, error) {
+	blank, err := cfg.dns.isBlank(ctx)
+	if err != nil || !blank {
+		return false, err
+	}
+	results := cfg.checkNodes(ctx, -1)
+	var candidates []candidate
+	for i, res := range results {
+		if res != nil && res.ok {
+			n := &cfg.nodes[i]
+			candidates = append(candidates, candidate{
+				node:   n,
+				result: *res,
+				rank:   cfg.rank(n, *res),
+			})
+		}
+	}
+	n := cfg.selector.selectNode(candidates)
+	if n == nil {
+		return false, errors.New("bootstrapping zone: no node is healthy")
+	}
+	notify("switch", n.name, "Bootstrapping zone, records point to "+n.name+" ("+n.target()+")")
+	if err := cfg.dns.bootstrapRecords(ctx, n.target(), n.ipv6); err != nil {
+		return false, err
+	}
+	cfg.switchedIP = switched{ip: n.target(), until: time.Now().Add(cfg.settle)}
+	cfg.switchedIPv6 = switched{ip: n.ipv6, until: time.Now().Add(cfg.settle)}
+	cfg.writeActive(n.name, n.target())
+	return true, nil
+}
+
+// groupCandidates returns candidates of the active group, or all candidates, when no node of the group is healthy
+func (cfg *config) groupCandidates(candidates []candidate) []candidate {
+	if cfg.activeGroup == "" {
+		return candidates
+	}
+	var group []candidate
+	for _, c := range candidates {
+		if c.node.group == cfg.activeGroup {
+			group = append(group, c)
+		}
+	}
+	if len(group) == 0 {
+		return candidates
+	}
+	return group
+}
+
+// exceptTarget returns candidates, the records of which do not point at the IP
+func exceptTarget(candidates []candidate, ip string) []candidate {
+	var others []candidate
+	for _, c := range candidates {
+		if !isContentEqual(c.node.target(), ip) {
+			others = append(others, c)
+		}
+	}
+	return others
+}
+
+// takeOver decides whether to switch the record, that points at an unknown IP
+func (cfg *config) takeOver(ctx context.Context, actualIP string) bool {
+	switch cfg.unknown {
+	case "hold":
+		log.Println("Hold unknown IP " + actualIP)
+		return false
+	case "confirm":
+		if cfg.checkNode(ctx, actualIP, cfg.watchURL).ok {
+			log.Println("Hold unknown IP " + actualIP + ", it is serving")
+			return false
+		}
+	}
+	return true
+}
+
+// sleep pauses for the duration, it returns early, when the context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// switchHeadroom is the time of DNS API requests of a switch besides the waits,
+// like rate limit waits and write retries
+const switchHeadroom = 30 * time.Second
+
+// switchTimeout returns the time limit of the DNS operations before or after the node checks,
+// the time includes the extra time of the provider switch, like the drain wait, and the propagation wait
+func (cfg *config) switchTimeout() time.Duration {
+	timeout := cfg.timeout + cfg.dns.switchWait() + switchHeadroom
+	if cfg.verifyPropagation {
+		// A and AAAA records are waited for one by one
+		timeout += 2 * cfg.propagationTimeout
+	}
+	return timeout
+}
+
+// watchCycle runs the watch cycle. The node checks are limited by the timeout,
+// the DNS operations have their own time limit, so a node, that does not respond, does not stop a failover.
+// The cycle has no ttl deadline, the next cycle is timed after the previous one ends
+func (cfg *config) watchCycle(ctx context.Context) error {
+	defer cfg.saveState()
+	defer cfg.logHistory()
+	return cfg.watch(ctx)
+}
+
+// interval returns the time to the next watch cycle, the ttl shifted by a random jitter
+func (cfg *config) interval() time.Duration {
+	if cfg.jitter <= 0 {
+		return cfg.ttl
+	}
+	interval := cfg.ttl - cfg.jitter + time.Duration(rand.Int63n(int64(2*cfg.jitter)+1))
+	if interval < time.Second {
+		return time.Second
+	}
+	return interval
+}
+
+// watch checks nodes and switches the records, the error joins errors of failed DNS operations
+func (cfg *config) watch(ctx context.Context) error {
+	cfg.dns.newCycle()
+	// DNS reads before the node checks
+	lookupCtx, cancelLookup := context.WithTimeout(ctx, cfg.switchTimeout())
+	defer cancelLookup()
+	cfg.resolveNodes(lookupCtx)
+	if cfg.bootstrap {
+		// records are created at the first run only
+		bootCtx, cancelBoot := context.WithTimeout(ctx, cfg.timeout+cfg.switchTimeout())
+		defer cancelBoot()
+		created, err := cfg.bootstrapZone(bootCtx)
+		if flushErr := cfg.dns.flush(bootCtx); err == nil {
+			err = flushErr
+		}
+		if err != nil {
+			// bootstrap is retried at the next cycle
+			notify("error", "", err.Error())
+			cfg.switchedIP = switched{}
+			cfg.switchedIPv6 = switched{}
+			return err
+		}
+		cfg.bootstrap = false
+		if created {
+			// new records are watched from the next cycle
+			return nil
+		}
+	}
+	if cfg.debug {
+		// records as the provider sees them before any change
+		cfg.logRecords(lookupCtx)
+	}
+	if cfg.roundRobin {
+		return cfg.watchRoundRobin(ctx)
+	}
+	// actual DNS records
+	actualIP, actualIPv6, err := cfg.lookupActual(lookupCtx)
+	if err != nil {
+		notify("error", "", err.Error())
+		return err
+	}
+	// failed DNS operations
+	var errs []error
+	// do not trust cached DNS records just after a switch
+	actualIP = cfg.switchedIP.actual(actualIP)
+	actualIPv6 = cfg.switchedIPv6.actual(actualIPv6)
+	// active node
+	var selected *node
+	// acting node still responds, so a switch is planned
+	planned := false
+	// acting node asks to shed new traffic
+	draining := false
+	// fastest node
+	var candidates []candidate
+	// least bad node
+	var degraded *node
+	var degradedResult checkResult
 	logMessage := ""
-	for _, n := range cfg.nodes {
+	acting := cfg.actingNode(lookupCtx, actualIP)
+	if acting >= 0 {
+		cfg.activeGroup = cfg.nodes[acting].group
+	}
+	results := cfg.checkNodes(ctx, acting)
+	// the switch is not limited by the time the checks took
+	ctx, cancelSwitch := context.WithTimeout(ctx, cfg.switchTimeout())
+	defer cancelSwitch()
+	// failure domain of the failed acting node
+	failedZone := ""
+	if acting >= 0 && results[acting] != nil && !results[acting].ok && !results[acting].draining {
+		failedZone = cfg.nodes[acting].zone
+	}
+	// node states of the status endpoint
+	var nodes []nodeStatus
+	for i := range cfg.nodes {
+		n := &cfg.nodes[i]
 		if logMessage != "" {
 			logMessage += ", "
 		}
-		// check node
-		ok, timeout := cfg.checkNode(n.ip)
 		logMessage += n.name
+		if n.maintenance != "" {
+			logMessage += " (maintenance)"
+		}
+		if results[i] == nil {
+			if n.maintenance == "" {
+				// early decision is made without the node, or the host name of the node is not resolved
+				logMessage += " skipped"
+				if i == acting && n.unresolved() && cfg.stateOf(n.name).up {
+					// the node state is unknown, the records are kept
+					selected = n
+				}
+			} else if i == acting {
+				// the record is moved from the node in maintenance, clients are drained
+				planned = true
+			}
+			nodes = append(nodes, nodeStatus{Name: n.name, IP: n.target(), Skipped: true, Maintenance: n.maintenance != ""})
+			continue
+		}
+		res := *results[i]
+		metrics.setNode(n.name, res)
+		var up, recovering bool
+		if res.draining {
+			up, recovering = cfg.drainState(n.name)
+		} else {
+			up, recovering = cfg.updateState(n.name, res.ok)
+		}
+		nodes = append(nodes, nodeStatus{
+			Name:        n.name,
+			IP:          n.target(),
+			Up:          up,
+			Check:       res.ok,
+			LatencyMS:   res.latency.Milliseconds(),
+			Fails:       cfg.states[n.name].fails,
+			Draining:    res.draining,
+			Maintenance: n.maintenance != "",
+			Uptime:      cfg.nodeUptime(n.name),
+		})
 		// note when the node is actual
-		if isAddrEqual(n.ip, actualIP) {
-			logMessage += " (" + n.ip
+		if i == acting {
+			logMessage += " (" + n.target()
 			if actualIPv6 != "" && isAddrEqual(actualIPv6, n.ipv6) {
 				logMessage += ", " + n.ipv6
 			}
 			logMessage += ")"
-			if ok {
-				selectedIPv6 = n.ipv6
-				selectedNode = n.name
+			if (res.ok || up) && n.maintenance == "" && !res.draining {
+				// a single failure is a blip, the record is not moved,
+				// but a draining node gets no new traffic at once
+				selected = n
 			}
+			planned = res.status != 0 || n.maintenance != ""
+			draining = res.draining
 		}
-		// lookup for the fastest node
-		if ok && timeout < minTimeout {
-			minIP = n.ip
-			minIPv6 = n.ipv6
-			minNode = n.name
-			minTimeout = timeout
+		// healthy node is a candidate for selection, a recovering node is behind any settled one
+		smoothed := res
+		if res.ok {
+			// a single fast check does not outrank a usually slow node
+			smoothed.latency = cfg.smoothLatency(n.name, res.latency)
+		}
+		rank := cfg.rank(n, smoothed)
+		if recovering {
+			rank += cfg.timeout
+		}
+		if failedZone != "" && n.zone == failedZone {
+			// the node may fail next
+			rank += cfg.domainBias
+		}
+		if res.ok && up && n.maintenance == "" && !res.draining {
+			candidates = append(candidates, candidate{
+				node:       n,
+				result:     res,
+				rank:       rank,
+				recovering: recovering,
+			})
+		}
+		// lookup for the least bad of responding nodes, a draining node is not a candidate
+		if !res.ok && !res.draining && res.status != 0 && n.maintenance == "" &&
+			(degraded == nil || cfg.lessDegraded(res, degradedResult)) {
+			degraded = n
+			degradedResult = res
 		}
 		// log node status
-		if ok {
-			logMessage += " " + strconv.Itoa(int(timeout/time.Millisecond)) + "ms"
+		if res.draining {
+			logMessage += " Draining " + strconv.Itoa(res.status)
+		} else if res.ok {
+			logMessage += " " + strconv.Itoa(int(res.latency/time.Millisecond)) + "ms"
+			if recovering {
+				logMessage += " recovering"
+			}
+		} else if res.status != 0 {
+			logMessage += " Fail " + strconv.Itoa(res.status)
 		} else {
 			logMessage += " Fail"
 		}
+		if !res.ok && !res.draining && up {
+			logMessage += " " + strconv.Itoa(cfg.states[n.name].fails) + "/" + strconv.Itoa(cfg.failThreshold)
+		} else if res.ok && !res.draining && !up {
+			logMessage += " rising " + strconv.Itoa(cfg.states[n.name].rises) + "/" + strconv.Itoa(cfg.riseThreshold)
+		}
+		logNode(n, res, up, i == acting)
 	}
-	log.Println(logMessage)
-	if selectedNode != "" && !isAddrEqual(selectedIPv6, actualIPv6) {
+	if jsonLog == nil {
+		// JSON log has a record by node instead
+		log.Println(logMessage)
+	}
+	// why the records are switched
+	reason := ""
+	// switched record contents by type, to verify the propagation
+	moved := map[string]string{}
+	// switch results are reported, when pending changes are applied
+	var reports []switchReport
+	if selected != nil && cfg.verifyRecord && !isAddrEqual(selected.ip, actualIP) {
+		// the node passes, but the record content may be quietly broken, for example, the virtual IP
+		if res := cfg.checkNode(ctx, actualIP, cfg.nodeURL(selected)); !res.ok {
+			notify("error", selected.name, "Record IP "+actualIP+" fails the check, "+selected.name+" passes")
+			selected = nil
+			planned = res.status != 0
+			draining = res.draining
+			candidates = exceptTarget(candidates, actualIP)
+			reason = "record IP fails the check"
+		}
+	}
+	if selected != nil {
+		cfg.writeActive(selected.name, selected.target())
+	}
+	if selected != nil && !isAddrEqual(selected.ipv6, actualIPv6) && !cfg.breaker.isOpen() {
 		// IPv6 adjustment for an acting node
-		log.Println("Switch IPv6 to " + selectedNode + " (" + selectedIPv6 + ")")
-		if err := cfg.cf.moveRecordsIPv6(actualIPv6, selectedIPv6); err != nil {
-			log.Println(err)
+		notify("switch", selected.name, "Switch IPv6 to "+selected.name+" ("+selected.ipv6+")")
+		err := cfg.dns.moveRecordsIPv6(ctx, actualIPv6, selected.ipv6)
+		if err != nil {
+			notify("error", selected.name, err.Error())
+			errs = append(errs, err)
+		} else {
+			cfg.switchedIPv6 = switched{ip: selected.ipv6, until: time.Now().Add(cfg.settle)}
+			moved["AAAA"] = selected.ipv6
+		}
+		reports = append(reports, switchReport{
+			recordType: "AAAA",
+			from:       actualIPv6,
+			to:         selected.ipv6,
+			reason:     "IPv6 of the acting node differs",
+			err:        err,
+		})
+	}
+	fastest := cfg.selector.selectNode(cfg.groupCandidates(candidates))
+	if selected != nil && fastest != nil && fastest.priority < selected.priority &&
+		cfg.states[fastest.name].recovered.IsZero() {
+		// the preferred node is healthy again
+		switch cfg.failback {
+		case "auto":
+			selected = nil
+			planned = true
+			reason = "failback to the preferred node"
+		case "manual":
+			if cfg.failbackNoted != fastest.name {
+				notify("state", fastest.name, "Failback to "+fastest.name+" is available, failback=manual")
+				cfg.failbackNoted = fastest.name
+			}
 		}
+	} else {
+		cfg.failbackNoted = ""
+	}
+	if selected == nil && fastest == nil && degraded != nil && cfg.degraded != "" &&
+		!isContentEqual(degraded.target(), actualIP) {
+		// no healthy node at all, selection the least bad node
+		notify("switch", degraded.name, "Degraded, no node is healthy, the least bad is "+degraded.name)
+		fastest = degraded
+		reason = "no node is healthy"
+	}
+	if acting < 0 && actualIP != "" {
+		// someone pointed the record elsewhere, or the node was removed from aw.ini
+		notify("error", "", "WARNING: record points at unknown IP "+actualIP)
+		if !cfg.takeOver(ctx, actualIP) {
+			fastest = nil
+		}
+		reason = "record points at unknown IP"
+	}
+	if selected == nil && fastest != nil && isContentEqual(fastest.target(), actualIP) {
+		// the fastest node already serves the acting virtual IP
+		fastest = nil
+	}
+	if selected == nil && fastest != nil && !cfg.breaker.allow() {
+		// the records may flap between nodes
+		notify("error", fastest.name, "CRITICAL: failover to "+fastest.name+" blocked by the circuit breaker")
+		errs = append(errs, errBreakerOpen)
+		fastest = nil
 	}
-	if selectedNode == "" && minIP != "" {
+	if selected == nil && fastest != nil {
 		// acting node failure, selection fastest node
-		log.Println("Switch IPv4 to " + minNode + " (" + minIP + ")")
-		if err := cfg.cf.moveRecords(actualIP, minIP); err != nil {
-			log.Println(err)
+		switch {
+		case reason != "":
+		case draining:
+			reason = "acting node is draining"
+		case planned:
+			reason = "acting node fails the check"
+		default:
+			reason = "acting node is down"
 		}
-		if !isAddrEqual(minIPv6, actualIPv6) {
+		notify("switch", fastest.name, "Switch IPv4 to "+fastest.name+" ("+fastest.target()+")")
+		names, err := cfg.dns.moveRecords(ctx, actualIP, fastest.target(), planned)
+		if len(names) > 0 {
+			log.Println("Changed A " + strings.Join(names, ", ") + " to " + fastest.target())
+		}
+		// a planned switch, like a failback or a drain, waits for the cooldown, the acting node still serves
+		postponed := errors.Is(err, errRecently) && planned
+		if errors.Is(err, errRecently) && !planned {
+			// traffic is stuck on a failing node
+			notify("error", fastest.name, "CRITICAL: failover to "+fastest.name+" blocked by cooldown, acting node is down")
+			errs = append(errs, err)
+		} else if postponed {
+			log.Println("Switch to " + fastest.name + " is blocked by cooldown, " + reason)
+		} else if err != nil {
+			notify("error", fastest.name, err.Error())
+			errs = append(errs, err)
+		} else {
+			cfg.switchedIP = switched{ip: fastest.target(), until: time.Now().Add(cfg.settle)}
+			moved["A"] = fastest.target()
+			if fastest.group != cfg.activeGroup {
+				if cfg.activeGroup != "" {
+					log.Println("Group " + cfg.activeGroup + " has no healthy node, switched to group " + fastest.group)
+				}
+				cfg.activeGroup = fastest.group
+			}
+		}
+		if !postponed {
+			reports = append(reports, switchReport{
+				recordType: "A",
+				from:       actualIP,
+				to:         fastest.target(),
+				reason:     reason,
+				names:      names,
+				err:        err,
+			})
+		}
+		if !isAddrEqual(fastest.ipv6, actualIPv6) {
 			// selection IPv6 of the fastest node
-			log.Println("Switch IPv6 to " + minNode + " (" + minIPv6 + ")")
-			if err := cfg.cf.moveRecordsIPv6(actualIPv6, minIPv6); err != nil {
-				log.Println(err)
+			notify("switch", fastest.name, "Switch IPv6 to "+fastest.name+" ("+fastest.ipv6+")")
+			err := cfg.dns.moveRecordsIPv6(ctx, actualIPv6, fastest.ipv6)
+			if err != nil {
+				notify("error", fastest.name, err.Error())
+				errs = append(errs, err)
+			} else {
+				cfg.switchedIPv6 = switched{ip: fastest.ipv6, until: time.Now().Add(cfg.settle)}
+				moved["AAAA"] = fastest.ipv6
 			}
+			reports = append(reports, switchReport{
+				recordType: "AAAA",
+				from:       actualIPv6,
+				to:         fastest.ipv6,
+				reason:     reason,
+				err:        err,
+			})
 		}
 	}
+	if _, ok := moved["A"]; ok && cfg.statusRecord != "" {
+		// service discovery reads the active node from DNS
+		content := "node=" + fastest.name + ",time=" + time.Now().UTC().Format(time.RFC3339)
+		if err := cfg.dns.writeText(ctx, cfg.statusRecord, content); err != nil {
+			notify("error", fastest.name, err.Error())
+			errs = append(errs, err)
+		}
+	}
+	flushErr := cfg.dns.flush(ctx)
+	if flushErr != nil {
+		// batched switches did not happen, trust DNS records again
+		notify("error", "", flushErr.Error())
+		cfg.switchedIP = switched{}
+		cfg.switchedIPv6 = switched{}
+		errs = append(errs, flushErr)
+	} else if cfg.dryRun {
+		// the records are not changed, public DNS records are actual
+		if _, ok := moved["A"]; ok {
+			cfg.switchedIP = switched{}
+		}
+		if _, ok := moved["AAAA"]; ok {
+			cfg.switchedIPv6 = switched{}
+		}
+	} else {
+		if _, ok := moved["A"]; ok {
+			cfg.writeActive(fastest.name, fastest.target())
+		}
+		if cfg.verifyPropagation {
+			for _, recordType := range []string{"A", "AAAA"} {
+				if content, ok := moved[recordType]; ok {
+					cfg.waitPropagation(ctx, recordType, content)
+				}
+			}
+		}
+	}
+	for _, r := range reports {
+		if r.err == nil {
+			// the batched switch failed
+			r.err = flushErr
+		}
+		cfg.reportSwitch(r)
+	}
+	err = errors.Join(errs...)
+	active := ""
+	if _, ok := moved["A"]; ok {
+		active = fastest.name
+	} else if acting >= 0 {
+		active = cfg.nodes[acting].name
+	}
+	cfg.publishStatus(active, actualIP, actualIPv6, moved, nodes, err)
+	return err
+}
+
+// reloadConfig reads the config file again, node states of the running config are kept.
+// It returns nil and logs all problems, when the new config is invalid
+func reloadConfig(running []*config, filename string) []*config {
+	if filename == "-" {
+		log.Println("Config reload failed, the standard input is read once, the running config is kept")
+		return nil
+	}
+	cfgs, err := loadConfig(filename)
+	if err == nil {
+		err = validateDomains(cfgs)
+	}
+	if err != nil {
+		log.Println("Config reload failed, the running config is kept: " + err.Error())
+		return nil
+	}
+	inheritDomains(cfgs, running)
+	log.Println("Config reloaded")
+	return cfgs
 }
 
 func main() {
-	cfg, err := loadConfig("aw.ini")
+	once := flag.Bool("once", false, "run a single watch cycle and exit, the exit code is 1 when a DNS operation fails")
+	configFile := flag.String("config", "", "config file name, - for the standard input or an HTTP URL, the AW_CONFIG variable or aw.ini by default")
+	checkConfig := flag.Bool("check-config", false, "print the parsed config and exit, the exit code is 1 when the config is invalid")
+	flag.Parse()
+	log.SetOutput(logOutput)
+	filename := configName(*configFile, flag.Arg(0))
+	cfgs, err := loadConfig(filename)
+	if err == nil {
+		err = validateDomains(cfgs)
+	}
 	if err != nil {
 		log.Println(err)
+		if *once || *checkConfig {
+			os.Exit(1)
+		}
 		return
 	}
+	if *checkConfig {
+		printConfig(filename, cfgs)
+		return
+	}
+	// the settings besides domain names are the same for all domains
+	cfg := cfgs[0]
+	if cfg.dryRun {
+		log.Println("Dry run, DNS records are not changed")
+	}
+	// in-flight requests are cancelled by SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *once {
+		// for cron jobs, no endpoints are served
+		if err := watchDomains(ctx, cfgs); err != nil {
+			stop()
+			os.Exit(1)
+		}
+		return
+	}
+	// a node with a wrong IP is found before the failover to it
+	if healthy := cfg.probeNodes(ctx); healthy == 0 && cfg.bootHealthy {
+		log.Println("No node is healthy at startup, requirehealthyboot is set")
+		stop()
+		os.Exit(1)
+	}
+	if cfg.listen != "" {
+		handle(cfg.listen, "/events", events)
+	}
+	if cfg.metrics != "" {
+		handle(cfg.metrics, "/metrics", metrics)
+	}
+	if cfg.statusAddr != "" {
+		handle(cfg.statusAddr, "/status", status)
+	}
+	serveListeners()
 	// examination
-	cfg.watch()
-	for range time.NewTicker(cfg.ttl).C {
-		cfg.watch()
+	watchDomains(ctx, cfgs)
+	// instances do not check the nodes at the same moment
+	timer := time.NewTimer(cfg.interval())
+	defer timer.Stop()
+	// the config is reloaded between watch cycles
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("shutting down")
+			return
+		case <-hup:
+			if reloaded := reloadConfig(cfgs, filename); reloaded != nil {
+				cfgs = reloaded
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(cfgs[0].interval())
+			}
+		case <-timer.C:
+			watchDomains(ctx, cfgs)
+			timer.Reset(cfgs[0].interval())
+		}
 	}
 }
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Settings of a test, the text is parsed like the ini file
+type mapIni struct {
+	sections []string
+	values   map[string]string
+}
+
+// parseIni returns settings of the text, keys before the first section are keys of the main section
+func parseIni(text string) *mapIni {
+	ini := &mapIni{values: map[string]string{}}
+	section := ""
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = line[1 : len(line)-1]
+			ini.sections = append(ini.sections, section)
+		default:
+			if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+				ini.values[section+"\x00"+strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+		}
+	}
+	return ini
+}
+
+func (ini *mapIni) Get(section, key string) string { return ini.values[section+"\x00"+key] }
+func (ini *mapIni) Sections() []string             { return ini.sections }
+func (ini *mapIni) Command(on bool)                {}
+
+func TestParseConfig(t *testing.T) {
+	cfgs, err := parseConfig(parseIni(`
+domain = example.com, example.org
+names = www
+url = https://www.example.com/
+timeout = 10
+connecttimeout = 20
+check = ping
+apitoken = token
+[node1]
+ip = 192.0.2.1
+[node2]
+ip = 192.0.2.2
+priority = 1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfgs) != 2 {
+		t.Fatalf("got %d configs, want 2", len(cfgs))
+	}
+	cfg := cfgs[1]
+	if cfg.domain != "example.org" {
+		t.Errorf("domain is %s, want example.org", cfg.domain)
+	}
+	if cfg.dialTimeout != 10*time.Second {
+		t.Errorf("connect timeout is %s, want the 10s timeout", cfg.dialTimeout)
+	}
+	if len(cfg.nodes) != 2 || cfg.nodes[1].ip != "192.0.2.2" || cfg.nodes[1].priority != 1 {
+		t.Errorf("nodes are %+v", cfg.nodes)
+	}
+	if cfgs[0].checks != cfgs[1].checks {
+		t.Error("domains do not share the node checks")
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		want string
+	}{
+		{"connecttimeout = 5s", "connecttimeout=5s is not a number"},
+		{"failthreshold = 0", "failthreshold=0 is not a number"},
+		{"check = tcp", "check=tcp needs checkport"},
+		{"provider = route53", "unknown provider route53"},
+	} {
+		_, err := parseConfig(parseIni("domain = example.com\nurl = https://example.com/\n" + tt.text))
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: got error %v, want %s", tt.text, err, tt.want)
+		}
+	}
+}
+
+func TestIsAddrEqual(t *testing.T) {
+	for _, tt := range []struct {
+		left, right string
+		want        bool
+	}{
+		{"192.0.2.1", "192.0.2.1", true},
+		{"192.0.2.1", "192.0.2.2", false},
+		{"2001:db8::1", "2001:0db8:0000:0000:0000:0000:0000:0001", true},
+		{"2001:DB8::1", "2001:db8::1", true},
+		{"2001:db8::1", "2001:db8::2", false},
+		{"fe80::1%eth0", "fe80::1", true},
+		{"fe80::1%eth0", "fe80::1%eth1", true},
+		{"::ffff:192.0.2.1", "192.0.2.1", true},
+		{"", "", true},
+		{"", "192.0.2.1", false},
+		{"192.0.2.256", "192.0.2.256", false},
+		{"node.example.com", "node.example.com", false},
+		{"2001:db8::1::2", "2001:db8::1::2", false},
+	} {
+		if got := isAddrEqual(tt.left, tt.right); got != tt.want {
+			t.Errorf("isAddrEqual(%q, %q) = %v, want %v", tt.left, tt.right, got, tt.want)
+		}
+	}
+}
+
+// Records of a test zone, the record contents are changed by the watch cycle
+type fakeDNS struct {
+	ip    string
+	ipv6  string
+	moves []string // targets of A record switches
+}
+
+func (f *fakeDNS) newCycle() {}
+
+func (f *fakeDNS) actualRecords(ctx context.Context) (string, string, error) {
+	return f.ip, f.ipv6, nil
+}
+
+func (f *fakeDNS) moveRecords(ctx context.Context, sourceIP, targetIP string, planned bool) ([]string, error) {
+	f.ip = targetIP
+	f.moves = append(f.moves, targetIP)
+	return []string{"www.example.com"}, nil
+}
+
+func (f *fakeDNS) moveRecordsIPv6(ctx context.Context, sourceIPv6, targetIPv6 string) error {
+	f.ipv6 = targetIPv6
+	return nil
+}
+
+func (f *fakeDNS) isBlank(ctx context.Context) (bool, error) { return f.ip == "", nil }
+
+func (f *fakeDNS) bootstrapRecords(ctx context.Context, ip, ipv6 string) error {
+	f.ip, f.ipv6 = ip, ipv6
+	return nil
+}
+
+func (f *fakeDNS) flush(ctx context.Context) error                              { return nil }
+func (f *fakeDNS) pinnedContents(name string) []string                          { return nil }
+func (f *fakeDNS) switchWait() time.Duration                                    { return 0 }
+func (f *fakeDNS) reconcileRecords(ctx context.Context, targets []string) error { return nil }
+func (f *fakeDNS) writeText(ctx context.Context, name, content string) error    { return nil }
+func (f *fakeDNS) describeRecords(ctx context.Context) ([]string, error)        { return nil, nil }
+
+// Health check endpoint of a test node, the status is changed by the test
+type fakeNode struct {
+	*httptest.Server
+	status int32        // response status
+	delay  int64        // response time, nanoseconds
+	path   atomic.Value // last checked path
+	host   atomic.Value // last Host header
+	// node url setting, blank for the watch URL
+	checkURL string
+	// extra keys of the node section
+	settings string
+}
+
+// newFakeNode starts the plain HTTP node, that passes the check after the delay
+func newFakeNode(t *testing.T, delay time.Duration) *fakeNode {
+	n := &fakeNode{status: http.StatusOK, delay: int64(delay)}
+	n.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.path.Store(r.URL.Path)
+		n.host.Store(r.Host)
+		time.Sleep(time.Duration(atomic.LoadInt64(&n.delay)))
+		w.WriteHeader(int(atomic.LoadInt32(&n.status)))
+	}))
+	t.Cleanup(n.Close)
+	n.checkURL = n.URL + "/health"
+	return n
+}
+
+// setStatus changes the response status of the node
+func (n *fakeNode) setStatus(status int) {
+	atomic.StoreInt32(&n.status, int32(status))
+}
+
+// setDelay changes the response time of the node
+func (n *fakeNode) setDelay(delay time.Duration) {
+	atomic.StoreInt64(&n.delay, int64(delay))
+}
+
+// port returns the listening port of the node
+func (n *fakeNode) port() string {
+	return n.URL[strings.LastIndexByte(n.URL, ':')+1:]
+}
+
+// newTestConfig returns the config of the main section keys and a node section by fake node, checked by the node url,
+// the node i record target is 192.0.2.<i+1>, the records point to the first node
+func newTestConfig(t *testing.T, text string, nodes ...*fakeNode) (*config, *fakeDNS) {
+	text = "domain = example.com\nnames = www\nsource = cloudflare\napitoken = token\n" + text
+	for i, n := range nodes {
+		text += "\n[node" + strconv.Itoa(i+1) + "]\nip = 127.0.0.1\nvip = 192.0.2." + strconv.Itoa(i+1) + "\n"
+		if n.checkURL != "" {
+			text += "url = " + n.checkURL + "\n"
+		}
+		text += n.settings
+	}
+	cfgs, err := parseConfig(parseIni(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns := &fakeDNS{ip: "192.0.2.1"}
+	cfgs[0].dns = dns
+	return cfgs[0], dns
+}
+
+// watchOnce runs the watch cycle with fresh node checks
+func watchOnce(t *testing.T, cfg *config) {
+	cfg.checks.reset()
+	if err := cfg.watch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlappingNodeKeepsRecord(t *testing.T) {
+	node1, node2 := newFakeNode(t, 0), newFakeNode(t, 0)
+	cfg, dns := newTestConfig(t, "url = https://www.example.com/\nfailthreshold = 3\n", node1, node2)
+	watchOnce(t, cfg)
+	for cycle := 0; cycle < 3; cycle++ {
+		// a single failure is a blip
+		node1.setStatus(http.StatusInternalServerError)
+		watchOnce(t, cfg)
+		node1.setStatus(http.StatusOK)
+		watchOnce(t, cfg)
+	}
+	if len(dns.moves) != 0 {
+		t.Fatalf("record moved to %v on single failures", dns.moves)
+	}
+	node1.setStatus(http.StatusInternalServerError)
+	for cycle := 1; cycle <= 3; cycle++ {
+		watchOnce(t, cfg)
+		if cycle < 3 && len(dns.moves) != 0 {
+			t.Fatalf("record moved after %d failures", cycle)
+		}
+	}
+	if len(dns.moves) != 1 || dns.ip != "192.0.2.2" {
+		t.Fatalf("record moves are %v, want one move to 192.0.2.2", dns.moves)
+	}
+}
+
+func TestRiseThreshold(t *testing.T) {
+	node1, node2 := newFakeNode(t, 0), newFakeNode(t, 0)
+	cfg, dns := newTestConfig(t, "url = https://www.example.com/\nfailthreshold = 1\nrisethreshold = 2\n", node1, node2)
+	node2.setStatus(http.StatusInternalServerError)
+	watchOnce(t, cfg)
+	node2.setStatus(http.StatusOK)
+	node1.setStatus(http.StatusInternalServerError)
+	// node2 passed once only, it is not selectable yet
+	watchOnce(t, cfg)
+	if len(dns.moves) != 0 {
+		t.Fatalf("record moved to %v before the node rose", dns.moves)
+	}
+	watchOnce(t, cfg)
+	if dns.ip != "192.0.2.2" {
+		t.Fatalf("record is %s, want 192.0.2.2", dns.ip)
+	}
+}
+
+func TestDrainingNode(t *testing.T) {
+	node1, node2 := newFakeNode(t, 0), newFakeNode(t, 0)
+	cfg, dns := newTestConfig(t, "url = https://www.example.com/\ndrainstatus = 503\n", node1, node2)
+	watchOnce(t, cfg)
+	node1.setStatus(http.StatusServiceUnavailable)
+	// the draining node gets no new traffic at once
+	watchOnce(t, cfg)
+	if dns.ip != "192.0.2.2" {
+		t.Fatalf("record is %s, want 192.0.2.2", dns.ip)
+	}
+	if s := cfg.states["node1"]; !s.up || s.fails != 0 {
+		t.Fatalf("draining node state is up %v, fails %d, want up without fails", s.up, s.fails)
+	}
+}
+
+func TestWatchURLHostDiffersFromDomain(t *testing.T) {
+	node := newFakeNode(t, 0)
+	// the node is checked by the watch URL, the health host is not a name of the managed domain
+	node.checkURL = ""
+	cfg, dns := newTestConfig(t, "url = http://health.example.net:"+node.port()+"/ready\n", node)
+	if cfg.checkHost != "health.example.net" || cfg.domain != "example.com" {
+		t.Fatalf("check host is %s, domain is %s", cfg.checkHost, cfg.domain)
+	}
+	watchOnce(t, cfg)
+	if host, _ := node.host.Load().(string); host != "health.example.net:"+node.port() {
+		t.Errorf("Host header is %s, want the watch URL host", host)
+	}
+	if path, _ := node.path.Load().(string); path != "/ready" {
+		t.Errorf("checked path is %s, want /ready", path)
+	}
+	if !cfg.states["node1"].up || dns.ip != "192.0.2.1" || len(dns.moves) != 0 {
+		t.Errorf("node is up %v, record is %s, moves %v", cfg.states["node1"].up, dns.ip, dns.moves)
+	}
+}
+
+func TestFastestNodeSelected(t *testing.T) {
+	node1 := newFakeNode(t, 0)
+	node2, node3 := newFakeNode(t, 300*time.Millisecond), newFakeNode(t, 200*time.Millisecond)
+	cfg, dns := newTestConfig(t, "url = https://www.example.com/\nfailthreshold = 1\n", node1, node2, node3)
+	node1.setStatus(http.StatusInternalServerError)
+	t0 := time.Now()
+	watchOnce(t, cfg)
+	if dns.ip != "192.0.2.3" {
+		t.Fatalf("record is %s, want the fastest node 192.0.2.3", dns.ip)
+	}
+	// the slow node does not delay the checks of other nodes
+	if elapsed := time.Since(t0); elapsed >= 450*time.Millisecond {
+		t.Errorf("watch cycle took %s, the nodes are checked one by one", elapsed)
+	}
+}
+
+func TestNodeURL(t *testing.T) {
+	node1, node2 := newFakeNode(t, 0), newFakeNode(t, 0)
+	node1.checkURL = node1.URL + "/healthz"
+	node2.checkURL = node2.URL + "/status"
+	cfg, _ := newTestConfig(t, "url = https://www.example.com/\n", node1, node2)
+	watchOnce(t, cfg)
+	for _, tt := range []struct {
+		node *fakeNode
+		path string
+	}{
+		{node1, "/healthz"},
+		{node2, "/status"},
+	} {
+		if path, _ := tt.node.path.Load().(string); path != tt.path {
+			t.Errorf("checked path is %s, want %s", path, tt.path)
+		}
+	}
+	if !cfg.states["node1"].up || !cfg.states["node2"].up {
+		t.Error("nodes are not up")
+	}
+}
+
+func TestPriorityBeatsLatency(t *testing.T) {
+	node1 := newFakeNode(t, 0)
+	node2, node3 := newFakeNode(t, 100*time.Millisecond), newFakeNode(t, 0)
+	node2.settings = "priority = 1\n"
+	node3.settings = "priority = 2\n"
+	cfg, dns := newTestConfig(t, "url = https://www.example.com/\nfailthreshold = 1\n", node1, node2, node3)
+	node1.setStatus(http.StatusInternalServerError)
+	watchOnce(t, cfg)
+	if dns.ip != "192.0.2.2" {
+		t.Fatalf("record is %s, want the slow preferred node 192.0.2.2", dns.ip)
+	}
+}
+
+func TestRecoveringPreferredNode(t *testing.T) {
+	primary, backup := &node{name: "primary", priority: 1}, &node{name: "backup", priority: 2}
+	candidates := []candidate{{node: primary, rank: time.Second, recovering: true}, {node: backup, rank: 2 * time.Second}}
+	// the primary node is still warming up
+	if n := (fastestSelector{}).selectNode(candidates); n != backup {
+		t.Fatalf("selected %v, want the settled backup node", n)
+	}
+	if n := (fastestSelector{}).selectNode(candidates[:1]); n != primary {
+		t.Fatalf("selected %v, want the only healthy node", n)
+	}
+	candidates[0].recovering = false
+	if n := (fastestSelector{}).selectNode(candidates); n != primary {
+		t.Fatalf("selected %v, want the settled primary node", n)
+	}
+}
+
+func TestEqualPriorityFastest(t *testing.T) {
+	slow, fast := &node{name: "slow", priority: 1}, &node{name: "fast", priority: 1}
+	candidates := []candidate{{node: slow, rank: 2 * time.Second}, {node: fast, rank: time.Second}}
+	if n := (fastestSelector{}).selectNode(candidates); n != fast {
+		t.Fatalf("selected %v, want the fast node", n)
+	}
+}
+
+func TestPlainHTTPCheck(t *testing.T) {
+	node := newFakeNode(t, 10*time.Millisecond)
+	cfg, _ := newTestConfig(t, "url = http://www.example.com/\n", node)
+	res := cfg.checkNode(context.Background(), "127.0.0.1", node.URL+"/health")
+	if !res.ok || res.status != http.StatusOK || res.latency < 10*time.Millisecond {
+		t.Fatalf("check result is %+v, want ok, status 200 and the latency", res)
+	}
+	watchOnce(t, cfg)
+	if s := cfg.states["node1"]; !s.checked || !s.up {
+		t.Fatal("node is not reported up")
+	}
+}
+
+func TestUnresolvedNodeSkipped(t *testing.T) {
+	for _, settings := range []string{
+		"hostname = node1.test\n",
+		// the record points to the resolved IP
+		"hostname = node1.test\nip =\nvip =\n",
+	} {
+		node1, node2 := newFakeNode(t, 0), newFakeNode(t, 0)
+		node1.settings = settings
+		cfg, dns := newTestConfig(t, "url = https://www.example.com/\nfailthreshold = 1\n", node1, node2)
+		// host names are resolved to 127.0.0.1
+		cfg.resolver = newResolver(serveDNS(t, 0))
+		if cfg.nodes[0].vip == "" {
+			dns.ip = "127.0.0.1"
+		}
+		actual := dns.ip
+		watchOnce(t, cfg)
+		if !cfg.states["node1"].up {
+			t.Fatal("resolved node is not up")
+		}
+		// the resolver does not answer
+		cfg.resolver = newResolver("127.0.0.1:1")
+		node1.setStatus(http.StatusInternalServerError)
+		watchOnce(t, cfg)
+		if s := cfg.states["node1"]; !s.up || s.fails != 0 {
+			t.Errorf("%q: unresolved node state is up %v, fails %d, want the state of the last check", settings, s.up, s.fails)
+		}
+		if len(dns.moves) != 0 || dns.ip != actual {
+			t.Errorf("%q: record moved to %v from the unresolved acting node", settings, dns.moves)
+		}
+	}
+}
+
+func TestUnresolvedNodeKeptRoundRobin(t *testing.T) {
+	node1, node2 := newFakeNode(t, 0), newFakeNode(t, 0)
+	node1.settings = "hostname = node1.test\nip =\nvip =\n"
+	cfg, _ := newTestConfig(t, "url = https://www.example.com/\nmode = roundrobin\nfailthreshold = 1\n", node1, node2)
+	cfg.resolver = newResolver(serveDNS(t, 0))
+	watchOnce(t, cfg)
+	if !cfg.served["127.0.0.1"] || !cfg.served["192.0.2.2"] {
+		t.Fatalf("served targets are %v", cfg.served)
+	}
+	cfg.resolver = newResolver("127.0.0.1:1")
+	watchOnce(t, cfg)
+	if !cfg.served["127.0.0.1"] {
+		t.Errorf("served targets are %v, want the last resolved IP kept", cfg.served)
+	}
+}
+
+func TestSettleDefault(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		want time.Duration
+	}{
+		{"", 300 * time.Second},
+		{"recordttl = 1", 300 * time.Second},
+		{"recordttl = 120", 120 * time.Second},
+		{"recordttl = 120\nsettle = 30", 30 * time.Second},
+	} {
+		cfgs, err := parseConfig(parseIni("domain = example.com\nurl = https://example.com/\napitoken = token\n" + tt.text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfgs[0].settle != tt.want {
+			t.Errorf("%q: settle is %s, want %s", tt.text, cfgs[0].settle, tt.want)
+		}
+	}
+}
+
+func TestEarlyCheckTimeout(t *testing.T) {
+	node1, node2, node3 := newFakeNode(t, 0), newFakeNode(t, 1500*time.Millisecond), newFakeNode(t, 0)
+	cfg, dns := newTestConfig(t, "url = https://www.example.com/\nearly = true\ntimeout = 1\nfailthreshold = 1\n", node1, node2, node3)
+	watchOnce(t, cfg)
+	// the hung node does not use up the time of the next check
+	if s := cfg.states["node3"]; s == nil || !s.up {
+		t.Error("node checked after the hung node is down")
+	}
+	if s := cfg.states["node2"]; s == nil || s.up {
+		t.Error("hung node is up")
+	}
+	if len(dns.moves) != 0 {
+		t.Errorf("record moved to %v, the acting node is healthy", dns.moves)
+	}
+}
+
+func TestOscillatingLatencyKeepsRecord(t *testing.T) {
+	node1, node2 := newFakeNode(t, 0), newFakeNode(t, 0)
+	cfg, dns := newTestConfig(t, "url = https://www.example.com/\nfailthreshold = 1\n", node1, node2)
+	for cycle := 0; cycle < 6; cycle++ {
+		// the nodes are faster in turn by a few milliseconds
+		if cycle%2 == 0 {
+			node1.setDelay(30 * time.Millisecond)
+			node2.setDelay(10 * time.Millisecond)
+		} else {
+			node1.setDelay(10 * time.Millisecond)
+			node2.setDelay(30 * time.Millisecond)
+		}
+		watchOnce(t, cfg)
+	}
+	if len(dns.moves) != 0 {
+		t.Fatalf("record moved to %v for speed, the acting node is healthy", dns.moves)
+	}
+	// the acting node fails, the record moves at once
+	node1.setStatus(http.StatusInternalServerError)
+	watchOnce(t, cfg)
+	if len(dns.moves) != 1 || dns.ip != "192.0.2.2" {
+		t.Fatalf("record moves are %v, want one move to 192.0.2.2", dns.moves)
+	}
+}
+
+func TestUnknownDegraded(t *testing.T) {
+	for value, valid := range map[string]bool{"latency": true, "Status": true, "fastest": false} {
+		_, err := parseConfig(parseIni("domain = example.com\nnames = www\nsource = cloudflare\napitoken = token\n" +
+			"url = https://www.example.com/\ndegraded = " + value + "\n[node1]\nip = 127.0.0.1\n"))
+		if valid && err != nil || !valid && err == nil {
+			t.Errorf("degraded=%s: got error %v", value, err)
+		}
+	}
+}
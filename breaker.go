@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Circuit breaker of failovers, too many failovers in the window stop record switches for a while
+type breaker struct {
+	max    int           // failovers allowed in the window, 0 for no limit
+	window time.Duration // time to count failovers in
+	wait   time.Duration // time the breaker stays open
+	moves  []time.Time   // failovers in the window
+	until  time.Time     // switches are blocked until
+}
+
+var errBreakerOpen = errors.New("circuit breaker is open, records are not switched")
+
+// isOpen reports whether record switches are blocked
+func (b *breaker) isOpen() bool {
+	return time.Now().Before(b.until)
+}
+
+// allow reports whether the failover is allowed, the breaker opens, when the window is full
+func (b *breaker) allow() bool {
+	if b.isOpen() {
+		return false
+	}
+	if b.max == 0 {
+		return true
+	}
+	now := time.Now()
+	for len(b.moves) > 0 && now.Sub(b.moves[0]) >= b.window {
+		b.moves = b.moves[1:]
+	}
+	if len(b.moves) < b.max {
+		return true
+	}
+	b.until = now.Add(b.wait)
+	b.moves = nil
+	log.Println("CRITICAL: " + strconv.Itoa(b.max) + " failovers in " + b.window.String() +
+		", circuit breaker is open until " + b.until.Format("15:04:05") + " or SIGHUP")
+	return false
+}
+
+// record counts the failover
+func (b *breaker) record() {
+	if b.max != 0 {
+		b.moves = append(b.moves, time.Now())
+	}
+}
@@ -2,49 +2,172 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/codeation/inifile"
 )
 
 // Zone record
 type cfRecord struct {
 	id       string
 	content  string
+	ttl      int
+	proxied  bool // orange-clouded, kept on update
 	modified time.Time
 }
 
 // CloudFlare account
 type cfAccount struct {
-	email  string
-	apiKey string
-	domain string
-	zoneID string
-	names  []string
+	email     string
+	apiKey    string
+	apiToken  string          // scoped API token, preferred over the global API key
+	client    *http.Client    // API client, shared by accounts of the config
+	bulkList  int             // more names than this are looked up by a zone records list
+	retries   int             // retries of a rate limited request
+	writes    int             // retries of a record write, that failed by a server or network error
+	dryRun    bool            // log changes instead of applying them
+	proxied   map[string]bool // names of records to create proxied
+	recordTTL int             // TTL of written records, 0 to keep the loaded TTL
+	maxWait   time.Duration   // maximum wait before a retry
+	baseURL   string          // API URL, requests paths are appended to
+	domain    string
+	zoneID    string
+	names     []string
+	pinned    map[string][]string // record contents to keep present by name
+	batches   map[string]*cfBatch // pending changes by zone ID, nil when changes are applied at once
 }
 
 // CloudFlare config
 type cfConfig struct {
-	ini *inifile.IniFile
+	ini          iniFile
+	domain       string
+	names        []string
+	zoneID       string // domain zone ID, the zoneid setting or looked up at the first use
+	pinned       map[string][]string
+	zones        []string     // IDs of DR zones, the records are switched in, besides the domain zone
+	client       *http.Client // API client, connections are reused between requests
+	bulkList     int          // names threshold of the zone records list
+	retries      int          // retries of a rate limited request
+	writes       int          // retries of a failed record write
+	dryRun       bool         // log record changes, the zone is not changed
+	proxied      map[string]bool
+	recordTTL    int           // TTL of switched and created records, seconds
+	cooldown     time.Duration // records updated recently are not changed
+	maxWait      time.Duration // maximum Retry-After wait
+	graceful     bool          // drain clients before a planned switch
+	drainTTL     int           // TTL while draining, seconds
+	drainWait    time.Duration // wait for the previous TTL to expire
+	drainRestore bool          // restore the previous TTL after the switch
+	batchWindow  time.Duration // coalescing window of record changes, 0 to apply changes at once
+	batches      map[string]*cfBatch
+	deletes      deleteLimit
+	noIPv6       bool // AAAA records are not read
+	skipMissing  bool // AAAA records are changed for the names with a record only, no record is created
+}
+
+// Pending changes of zone records, applied by a single batch request
+type cfBatch struct {
+	started time.Time
+	deletes map[string]bool            // by record ID
+	puts    map[string]cfRecordRequest // by record ID
+	posts   map[string]cfRecordRequest // by type, name and content
 }
 
 var errNotFound = errors.New("record not found")
 
+var errRecently = errors.New("record updated recently")
+
+// Switch of the records, some out of date records of which are updated recently and are not changed
+type partialSwitchError struct {
+	recordType string
+	changed    []string // full names of the changed records
+	skipped    []string // full names of the records updated recently
+}
+
+func (e *partialSwitchError) Error() string {
+	return e.recordType + " " + strings.Join(e.skipped, ", ") + " updated recently, only " +
+		strings.Join(e.changed, ", ") + " changed"
+}
+
+func (e *partialSwitchError) Unwrap() error {
+	return errRecently
+}
+
+var errRateLimited = errors.New("CloudFlare API rate limit exceeded, retries exhausted")
+
+// CloudFlare API error response
+type cfError struct {
+	status int
+	Errors []struct {
+		Code    int
+		Message string
+	}
+}
+
+// Error returns the first error code and message of the response, or the HTTP status text
+func (e *cfError) Error() string {
+	if len(e.Errors) == 0 {
+		return http.StatusText(e.status)
+	}
+	return "cloudflare: " + strconv.Itoa(e.Errors[0].Code) + " " + e.Errors[0].Message
+}
+
+// CloudFlare error codes of an existing record
+const (
+	cfRecordExists    = 81057
+	cfIdenticalExists = 81058
+)
+
+// Error of a zone change
+type zoneError struct {
+	zoneID string
+	err    error
+}
+
+func (e *zoneError) Error() string {
+	return "zone " + e.zoneID + ": " + e.err.Error()
+}
+
+func (e *zoneError) Unwrap() error {
+	return e.err
+}
+
+// hasCode reports whether the error is a CloudFlare error with one of the codes
+func hasCode(err error, codes ...int) bool {
+	var cfErr *cfError
+	if !errors.As(err, &cfErr) {
+		return false
+	}
+	for _, e := range cfErr.Errors {
+		for _, code := range codes {
+			if e.Code == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type cfRecordRequest struct {
 	Type    string `json:"type"`
 	Name    string `json:"name"`
 	Content string `json:"content"`
+	TTL     int    `json:"ttl,omitempty"`
 	Proxied bool   `json:"proxied"`
 }
 
-// request parses the CloudFlare response
-func (cf *cfAccount) request(method, url string, body interface{}, v interface{}) error {
-	client := &http.Client{}
+// request parses the CloudFlare response, a rate limited request is retried after the Retry-After delay
+func (cf *cfAccount) request(ctx context.Context, method, url string, body interface{}, v interface{}) error {
 	reqBody, err := json.Marshal(body)
 	if err != nil {
 		return err
@@ -52,144 +175,473 @@ func (cf *cfAccount) request(method, url string, body interface{}, v interface{}
 	if body == nil {
 		reqBody = nil
 	}
-	url = "https://api.cloudflare.com/client/v4" + url
-	req, err := http.NewRequest(method, url, bytes.NewReader(reqBody))
+	url = cf.baseURL + url
+	for retry := 0; ; retry++ {
+		wait, err := cf.do(ctx, method, url, reqBody, v)
+		if err == nil {
+			return nil
+		}
+		if err != errRateLimited || retry >= cf.retries {
+			metrics.apiError("cloudflare")
+			return err
+		}
+		if wait > cf.maxWait {
+			wait = cf.maxWait
+		}
+		log.Println("CloudFlare API rate limit, retry in " + wait.String())
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// writeBackoff is the wait before the first retry of a record write, the wait doubles by retry
+const writeBackoff = 500 * time.Millisecond
+
+// writeRequest makes the record write request, a server or network error is retried with exponential backoff
+func (cf *cfAccount) writeRequest(ctx context.Context, method, url string, body interface{}, v interface{}) error {
+	backoff := writeBackoff
+	for retry := 0; ; retry++ {
+		err := cf.request(ctx, method, url, body, v)
+		if err == nil || retry >= cf.writes || !isTransient(ctx, err) {
+			return err
+		}
+		// the jitter keeps concurrent runs apart
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)))
+		log.Println("CloudFlare API write failed, retry in " + wait.String() + ": " + err.Error())
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// isTransient reports whether the request error is a server or network error, that may pass on retry
+func isTransient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || err == errRateLimited {
+		return false
+	}
+	var cfErr *cfError
+	if errors.As(err, &cfErr) {
+		return cfErr.status >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryAfter parses the Retry-After header, seconds or HTTP date
+func retryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return time.Second
+}
+
+// do makes the single request, a rate limited response returns the wait before a retry
+func (cf *cfAccount) do(ctx context.Context, method, url string, reqBody []byte, v interface{}) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(reqBody))
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if cf.apiToken != "" {
+		req.Header.Add("Authorization", "Bearer "+cf.apiToken)
+	} else {
+		req.Header.Add("X-Auth-Email", cf.email)
+		req.Header.Add("X-Auth-Key", cf.apiKey)
 	}
-	req.Header.Add("X-Auth-Email", cf.email)
-	req.Header.Add("X-Auth-Key", cf.apiKey)
 	req.Header.Add("Content-Type", "application/json")
-	resp, err := client.Do(req)
+	resp, err := cf.client.Do(req)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return retryAfter(resp.Header.Get("Retry-After")), errRateLimited
+	}
 	if resp.StatusCode != http.StatusOK {
-		return errors.New(http.StatusText(resp.StatusCode))
+		cfErr := &cfError{status: resp.StatusCode}
+		json.Unmarshal(data, cfErr) // the status is enough, when the body is not parsed
+		return 0, cfErr
 	}
-	data, err := ioutil.ReadAll(resp.Body)
+	return 0, json.Unmarshal(data, v)
+}
+
+// fullName returns the domain name of the record
+func (cf *cfAccount) fullName(name string) string {
+	if name == "@" {
+		return cf.domain
+	}
+	return name + "." + cf.domain
+}
+
+// Zone record of a list response
+type cfListResult struct {
+	ID       string
+	Name     string
+	Content  string
+	TTL      int
+	Proxied  bool
+	Modified string `json:"modified_on"`
+}
+
+// record converts the list result to the zone record
+func (result *cfListResult) record() (cfRecord, error) {
+	modified, err := time.Parse(time.RFC3339, result.Modified)
 	if err != nil {
-		return err
+		return cfRecord{}, err
 	}
-	return json.Unmarshal(data, v)
+	return cfRecord{
+		id:       result.ID,
+		content:  result.Content,
+		ttl:      result.TTL,
+		proxied:  result.Proxied,
+		modified: modified,
+	}, nil
 }
 
-// loadRecords reads zone records
-func (cf *cfAccount) loadRecords(names []string, recordType string) (map[string]cfRecord, error) {
-	records := map[string]cfRecord{}
-	for _, name := range names {
-		fullname := name + "." + cf.domain
-		if name == "@" {
-			fullname = cf.domain
-		}
-		url := "/zones/" + cf.zoneID + "/dns_records" +
-			"?type=" + recordType + "&name=" + fullname + "&match=all"
+// listPages reads zone records of the query page by page
+func (cf *cfAccount) listPages(ctx context.Context, query string) ([]cfListResult, error) {
+	var results []cfListResult
+	for page := 1; ; page++ {
+		url := "/zones/" + cf.zoneID + "/dns_records" + query + "&per_page=100&page=" + strconv.Itoa(page)
 		var record struct {
-			Result []struct {
-				ID       string
-				Content  string
-				Modified string `json:"modified_on"`
-			}
+			Result     []cfListResult
+			ResultInfo struct {
+				TotalPages int `json:"total_pages"`
+			} `json:"result_info"`
 		}
-		if err := cf.request("GET", url, nil, &record); err != nil {
+		if err := cf.request(ctx, "GET", url, nil, &record); err != nil {
 			return nil, err
 		}
-		if len(record.Result) == 0 {
-			return nil, errNotFound
+		results = append(results, record.Result...)
+		if page >= record.ResultInfo.TotalPages {
+			return results, nil
 		}
-		modified, err := time.Parse(time.RFC3339, record.Result[0].Modified)
+	}
+}
+
+// listRecords reads all zone records of the name
+func (cf *cfAccount) listRecords(ctx context.Context, name string, recordType string) ([]cfRecord, error) {
+	results, err := cf.listPages(ctx, "?type="+recordType+"&name="+cf.fullName(name)+"&match=all")
+	if err != nil {
+		return nil, err
+	}
+	var records []cfRecord
+	for _, result := range results {
+		r, err := result.record()
 		if err != nil {
 			return nil, err
 		}
-		records[name] = cfRecord{
-			id:       record.Result[0].ID,
-			content:  record.Result[0].Content,
-			modified: modified,
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// listZoneRecords reads all zone records of the type, the records are grouped by full name
+func (cf *cfAccount) listZoneRecords(ctx context.Context, recordType string) (map[string][]cfRecord, error) {
+	results, err := cf.listPages(ctx, "?type="+recordType)
+	if err != nil {
+		return nil, err
+	}
+	records := map[string][]cfRecord{}
+	for _, result := range results {
+		r, err := result.record()
+		if err != nil {
+			return nil, err
 		}
+		name := strings.ToLower(result.Name)
+		records[name] = append(records[name], r)
 	}
 	return records, nil
 }
 
-// setRecords changes previosly loaded zone records to a new IP
-func (cf *cfAccount) setRecords(ip string, recordType string, records map[string]cfRecord) error {
+// isPinned reports whether the record content is pinned for the name
+func (cf *cfAccount) isPinned(name string, content string) bool {
+	for _, pinned := range cf.pinned[name] {
+		if isAddrEqual(pinned, content) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRecords reads zone records, pinned records are skipped, the record TTL is kept unless recordttl is set.
+// Duplicate records of a name are an error, so a wrong record is never changed
+func (cf *cfAccount) loadRecords(ctx context.Context, names []string, recordType string) (map[string]cfRecord, error) {
+	var zone map[string][]cfRecord
+	if len(names) > cf.bulkList {
+		// a dozen of GET requests is slow
+		var err error
+		if zone, err = cf.listZoneRecords(ctx, recordType); err != nil {
+			return nil, err
+		}
+	}
+	records := map[string]cfRecord{}
+	for _, name := range names {
+		var list []cfRecord
+		if zone != nil {
+			list = zone[strings.ToLower(cf.fullName(name))]
+		} else {
+			var err error
+			if list, err = cf.listRecords(ctx, name, recordType); err != nil {
+				return nil, err
+			}
+		}
+		found := 0
+		for _, r := range list {
+			if !cf.isPinned(name, r.content) {
+				if cf.recordTTL != 0 {
+					// the configured TTL overrides the zone one
+					r.ttl = cf.recordTTL
+				}
+				records[name] = r
+				found++
+			}
+		}
+		if found == 0 {
+			return nil, errNotFound
+		}
+		if found > 1 {
+			return nil, errors.New(strconv.Itoa(found) + " " + recordType + " records of " + cf.fullName(name) +
+				" found, expected one, remove duplicates or pin them")
+		}
+	}
+	return records, nil
+}
+
+// setRecords changes previosly loaded zone records to a new IP, the records TTL is kept
+func (cf *cfAccount) setRecords(ctx context.Context, ip string, recordType string, records map[string]cfRecord) error {
+	if cf.dryRun {
+		for name, r := range records {
+			log.Println("Dry run: set " + recordType + " " + cf.fullName(name) + " " + r.content + " to " + ip)
+		}
+		return nil
+	}
+	changed := map[string]cfRecord{}
 	for name, r := range records {
-		fullname := name + "." + cf.domain
-		if name == "@" {
-			fullname = cf.domain
+		r.content = ip
+		changed[name] = r
+	}
+	return cf.updateRecords(ctx, recordType, changed)
+}
+
+// batch returns pending changes of the zone, or nil when changes are applied at once
+func (cf *cfAccount) batch() *cfBatch {
+	if cf.batches == nil {
+		return nil
+	}
+	b, ok := cf.batches[cf.zoneID]
+	if !ok {
+		b = &cfBatch{
+			started: time.Now(),
+			deletes: map[string]bool{},
+			puts:    map[string]cfRecordRequest{},
+			posts:   map[string]cfRecordRequest{},
+		}
+		cf.batches[cf.zoneID] = b
+	}
+	return b
+}
+
+// putRecord writes the zone record
+func (cf *cfAccount) putRecord(ctx context.Context, id string, body *cfRecordRequest) error {
+	if b := cf.batch(); b != nil {
+		// the last change of the record wins
+		b.puts[id] = *body
+		return nil
+	}
+	url := "/zones/" + cf.zoneID + "/dns_records/" + id
+	var record struct {
+		Result struct {
+			Content string
+		}
+	}
+	if err := cf.writeRequest(ctx, "PUT", url, body, &record); err != nil {
+		return err
+	}
+	if !isContentEqual(record.Result.Content, body.Content) {
+		return errors.New("set record " + body.Name + " to " + body.Content + " error, still " + record.Result.Content)
+	}
+	return nil
+}
+
+// postRecord creates the zone record
+func (cf *cfAccount) postRecord(ctx context.Context, body *cfRecordRequest) error {
+	if b := cf.batch(); b != nil {
+		b.posts[body.Type+" "+body.Name+" "+body.Content] = *body
+		return nil
+	}
+	url := "/zones/" + cf.zoneID + "/dns_records"
+	var record struct {
+		Result struct {
+			Content string
 		}
-		url := "/zones/" + cf.zoneID + "/dns_records/" + r.id
+	}
+	if err := cf.writeRequest(ctx, "POST", url, body, &record); err != nil {
+		return err
+	}
+	if !isContentEqual(record.Result.Content, body.Content) {
+		return errors.New("set record " + body.Name + " to " + body.Content + " error, still " + record.Result.Content)
+	}
+	return nil
+}
+
+// deleteRecord deletes the zone record
+func (cf *cfAccount) deleteRecord(ctx context.Context, id string) error {
+	if b := cf.batch(); b != nil {
+		// no need to change a deleted record
+		delete(b.puts, id)
+		b.deletes[id] = true
+		return nil
+	}
+	url := "/zones/" + cf.zoneID + "/dns_records/" + id
+	var record struct{}
+	return cf.request(ctx, "DELETE", url, nil, &record)
+}
+
+// updateRecords writes previosly loaded zone records with their content, TTL and proxy status
+func (cf *cfAccount) updateRecords(ctx context.Context, recordType string, records map[string]cfRecord) error {
+	for name, r := range records {
 		body := &cfRecordRequest{
 			Type:    recordType,
-			Name:    fullname,
-			Content: ip,
-			Proxied: false,
-		}
-		var record struct {
-			Result struct {
-				Content string
-			}
+			Name:    cf.fullName(name),
+			Content: r.content,
+			TTL:     r.ttl,
+			Proxied: r.proxied,
 		}
-		if err := cf.request("PUT", url, body, &record); err != nil {
+		if err := cf.putRecord(ctx, r.id, body); err != nil {
 			return err
 		}
-		if !isAddrEqual(record.Result.Content, ip) {
-			return errors.New("set record " + name + " to " + ip + " error, still " + record.Result.Content)
-		}
 	}
 	return nil
 }
 
 // createRecords creates zone records
-func (cf *cfAccount) createRecords(ip string, recordType string, names []string) error {
+func (cf *cfAccount) createRecords(ctx context.Context, ip string, recordType string, names []string) error {
 	for _, name := range names {
-		fullname := name + "." + cf.domain
-		if name == "@" {
-			fullname = cf.domain
+		if cf.dryRun {
+			log.Println("Dry run: create " + recordType + " " + cf.fullName(name) + " " + ip)
+			continue
 		}
-		url := "/zones/" + cf.zoneID + "/dns_records"
 		body := &cfRecordRequest{
 			Type:    recordType,
-			Name:    fullname,
+			Name:    cf.fullName(name),
 			Content: ip,
-			Proxied: false,
+			TTL:     cf.recordTTL,
+			Proxied: cf.proxied[name],
 		}
-		var record struct {
-			Result struct {
-				Content string
-			}
+		err := cf.postRecord(ctx, body)
+		if hasCode(err, cfIdenticalExists) {
+			// the record is already as required
+			continue
+		}
+		if hasCode(err, cfRecordExists) && !cf.isPinned(name, ip) {
+			// concurrent run or partial prior state, update the existing record
+			err = cf.upsertRecord(ctx, name, body)
 		}
-		if err := cf.request("POST", url, body, &record); err != nil {
+		if err != nil {
 			return err
 		}
-		if !isAddrEqual(record.Result.Content, ip) {
-			return errors.New("set record " + name + " to " + ip + " error, still " + record.Result.Content)
+	}
+	return nil
+}
+
+// upsertRecord changes the existing zone record to the record content
+func (cf *cfAccount) upsertRecord(ctx context.Context, name string, body *cfRecordRequest) error {
+	records, err := cf.loadRecords(ctx, []string{name}, body.Type)
+	if err != nil {
+		return err
+	}
+	return cf.setRecords(ctx, body.Content, body.Type, records)
+}
+
+// deleteRecords deletes zone records, pinned records are never deleted
+func (cf *cfAccount) deleteRecords(ctx context.Context, recordType string, records map[string]cfRecord) error {
+	for name, r := range records {
+		if cf.isPinned(name, r.content) {
+			continue
+		}
+		if cf.dryRun {
+			log.Println("Dry run: delete " + recordType + " " + cf.fullName(name) + " " + r.content)
+			continue
+		}
+		if err := cf.deleteRecord(ctx, r.id); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// deleteRecords deletes zone records
-func (cf *cfAccount) deleteRecords(recordType string, records map[string]cfRecord) error {
-	for _, r := range records {
-		url := "/zones/" + cf.zoneID + "/dns_records/" + r.id
-		var record struct{}
-		if err := cf.request("DELETE", url, nil, &record); err != nil {
+// ensurePinned creates missing pinned records of the record type
+func (cf *cfAccount) ensurePinned(ctx context.Context, recordType string) error {
+	for name, contents := range cf.pinned {
+		list, err := cf.listRecords(ctx, name, recordType)
+		if err != nil {
 			return err
 		}
+		for _, content := range contents {
+			ip := net.ParseIP(content)
+			if ip == nil || (ip.To4() != nil) != (recordType == "A") {
+				// other record type
+				continue
+			}
+			found := false
+			for _, r := range list {
+				if isAddrEqual(r.content, content) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				if err := cf.createRecords(ctx, content, recordType, []string{name}); err != nil {
+					return err
+				}
+			}
+		}
 	}
 	return nil
 }
 
+// contentType returns the type of the record content, CNAME for a host name
+func contentType(content string) string {
+	ip := net.ParseIP(content)
+	switch {
+	case ip == nil:
+		return "CNAME"
+	case ip.To4() != nil:
+		return "A"
+	default:
+		return "AAAA"
+	}
+}
+
+// loadTargetRecords reads A records of the names, or CNAME records, when the names point at a host name.
+// It returns the records and their type
+func (cf *cfAccount) loadTargetRecords(ctx context.Context, names []string) (map[string]cfRecord, string, error) {
+	records, err := cf.loadRecords(ctx, names, "A")
+	if err != errNotFound {
+		return records, "A", err
+	}
+	records, err = cf.loadRecords(ctx, names, "CNAME")
+	return records, "CNAME", err
+}
+
 // loadZone reads zone ID
-func (cf *cfAccount) loadZone() error {
+func (cf *cfAccount) loadZone(ctx context.Context) error {
 	url := "/zones?name=" + cf.domain
 	var zone struct {
 		Result []struct {
 			ID string
 		}
 	}
-	if err := cf.request("GET", url, nil, &zone); err != nil {
+	if err := cf.request(ctx, "GET", url, nil, &zone); err != nil {
 		return err
 	}
 	if len(zone.Result) != 1 {
@@ -199,68 +651,700 @@ func (cf *cfAccount) loadZone() error {
 	return nil
 }
 
-// newAccount saves account credentials and reads zone ID and zone records
-func (c *cfConfig) newAccount() *cfAccount {
-	return &cfAccount{
-		email:  c.ini.Get("", "email"),
-		apiKey: c.ini.Get("", "apikey"),
-		domain: c.ini.Get("", "domain"),
-		names:  strings.Split(c.ini.Get("", "names"), ","),
+// domainAccount returns the account of the domain zone, the zone ID is looked up once
+func (c *cfConfig) domainAccount(ctx context.Context) (*cfAccount, error) {
+	cf, err := c.newAccount()
+	if err != nil {
+		return nil, err
+	}
+	if c.zoneID != "" {
+		cf.zoneID = c.zoneID
+		return cf, nil
+	}
+	if err := cf.loadZone(ctx); err != nil {
+		return nil, err
+	}
+	c.zoneID = cf.zoneID
+	return cf, nil
+}
+
+// parsePinned parses the list of name:content pairs
+func parsePinned(value string) map[string][]string {
+	pinned := map[string][]string{}
+	for _, pair := range strings.Split(value, ",") {
+		// IPv6 content contains colons too
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		pinned[parts[0]] = append(pinned[parts[0]], parts[1])
+	}
+	return pinned
+}
+
+// cfBaseURL is the CloudFlare API URL by default
+const cfBaseURL = "https://api.cloudflare.com/client/v4"
+
+// cfCredentials are environment variables of the credentials by ini key, a variable overrides the ini value
+var cfCredentials = [][2]string{
+	{"email", "AW_CF_EMAIL"},
+	{"apikey", "AW_CF_APIKEY"},
+	{"apitoken", "AW_CF_TOKEN"},
+}
+
+// credential returns the credential of the environment variable, or of the ini key, and the source name
+func credential(ini iniFile, key, env string) (string, string) {
+	if value := os.Getenv(env); value != "" {
+		return value, env
+	}
+	return ini.Get("", key), key
+}
+
+// newAccount saves account credentials, the API token or the email and the global API key
+func (c *cfConfig) newAccount() (*cfAccount, error) {
+	email, _ := credential(c.ini, "email", "AW_CF_EMAIL")
+	apiKey, _ := credential(c.ini, "apikey", "AW_CF_APIKEY")
+	apiToken, _ := credential(c.ini, "apitoken", "AW_CF_TOKEN")
+	cf := &cfAccount{
+		email:     email,
+		apiKey:    apiKey,
+		apiToken:  apiToken,
+		client:    c.client,
+		bulkList:  c.bulkList,
+		retries:   c.retries,
+		writes:    c.writes,
+		dryRun:    c.dryRun,
+		proxied:   c.proxied,
+		recordTTL: c.recordTTL,
+		maxWait:   c.maxWait,
+		baseURL:   strings.TrimSuffix(c.ini.Get("", "cfbaseurl"), "/"),
+		domain:    c.domain,
+		names:     c.names,
+		pinned:    c.pinned,
+		batches:   c.batches,
+	}
+	if cf.baseURL == "" {
+		cf.baseURL = cfBaseURL
+	}
+	if cf.apiToken == "" && (cf.email == "" || cf.apiKey == "") {
+		return nil, errors.New("CloudFlare credentials are missing, set apitoken or email and apikey, or the AW_CF_ variables")
+	}
+	return cf, nil
+}
+
+// flush applies pending changes of zone records by batch requests.
+// It waits for the coalescing window, so close changes are applied together
+func (c *cfConfig) flush(ctx context.Context) error {
+	for zoneID, b := range c.batches {
+		delete(c.batches, zoneID)
+		if err := sleep(ctx, time.Until(b.started.Add(c.batchWindow))); err != nil {
+			return err
+		}
+		type batchID struct {
+			ID string `json:"id"`
+		}
+		type batchPut struct {
+			ID string `json:"id"`
+			cfRecordRequest
+		}
+		var body struct {
+			Deletes []batchID         `json:"deletes,omitempty"`
+			Puts    []batchPut        `json:"puts,omitempty"`
+			Posts   []cfRecordRequest `json:"posts,omitempty"`
+		}
+		for id := range b.deletes {
+			body.Deletes = append(body.Deletes, batchID{ID: id})
+		}
+		for id, r := range b.puts {
+			body.Puts = append(body.Puts, batchPut{ID: id, cfRecordRequest: r})
+		}
+		for _, r := range b.posts {
+			body.Posts = append(body.Posts, r)
+		}
+		cf, err := c.newAccount()
+		if err != nil {
+			return err
+		}
+		cf.zoneID = zoneID
+		cf.batches = nil
+		var result struct{}
+		if err := cf.request(ctx, "POST", "/zones/"+zoneID+"/dns_records/batch", &body, &result); err != nil {
+			return err
+		}
+		log.Println("Batch applied: " + strconv.Itoa(len(body.Deletes)) + " deleted, " +
+			strconv.Itoa(len(body.Puts)) + " changed, " + strconv.Itoa(len(body.Posts)) + " created")
 	}
+	return nil
 }
 
-// moveRecords changes specified A records from sourceIP to targetIP
-func (c *cfConfig) moveRecords(sourceIP, targetIP string) error {
-	cf := c.newAccount()
-	if err := cf.loadZone(); err != nil {
+// drainRecords lowers TTL of zone records, waits for the previous TTL to expire,
+// changes the records to a new IP and optionally restores the previous TTL
+func (c *cfConfig) drainRecords(ctx context.Context, cf *cfAccount, ip string, recordType string, records map[string]cfRecord) error {
+	drained := map[string]cfRecord{}
+	for name, r := range records {
+		r.ttl = c.drainTTL
+		drained[name] = r
+	}
+	log.Println("Drain " + recordType + " records: TTL " + strconv.Itoa(c.drainTTL) + "s, wait " + c.drainWait.String())
+	if err := cf.updateRecords(ctx, recordType, drained); err != nil {
+		return err
+	}
+	// phases are not coalesced
+	if err := c.flush(ctx); err != nil {
+		return err
+	}
+	if err := sleep(ctx, c.drainWait); err != nil {
 		return err
 	}
-	records, err := cf.loadRecords(cf.names, "A")
+	log.Println("Drain " + recordType + " records: switch to " + ip)
+	if err := cf.setRecords(ctx, ip, contentType(ip), drained); err != nil {
+		return err
+	}
+	if err := c.flush(ctx); err != nil {
+		return err
+	}
+	if !c.drainRestore {
+		return nil
+	}
+	log.Println("Drain " + recordType + " records: restore TTL")
+	return cf.setRecords(ctx, ip, contentType(ip), records)
+}
+
+// zoneAccounts returns accounts of the domain zone and DR zones
+func (c *cfConfig) zoneAccounts(ctx context.Context) ([]*cfAccount, error) {
+	cf, err := c.domainAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	accounts := []*cfAccount{cf}
+	for _, zoneID := range c.zones {
+		dr, err := c.newAccount()
+		if err != nil {
+			return nil, err
+		}
+		dr.zoneID = zoneID
+		accounts = append(accounts, dr)
+	}
+	return accounts, nil
+}
+
+// eachZone applies the change to every zone, a failed zone does not stop the change of other zones.
+// Results are logged by zone, the error joins errors of failed zones
+func (c *cfConfig) eachZone(ctx context.Context, change func(cf *cfAccount) error) error {
+	accounts, err := c.zoneAccounts(ctx)
 	if err != nil {
 		return err
 	}
-	if sourceIP != "" && !isAddrEqual(records["@"].content, sourceIP) {
-		return errors.New("stated IP is " + records["@"].content)
+	if len(accounts) == 1 {
+		return change(accounts[0])
+	}
+	var errs []error
+	for _, cf := range accounts {
+		if err := change(cf); err != nil {
+			errs = append(errs, &zoneError{zoneID: cf.zoneID, err: err})
+			log.Println("Zone " + cf.zoneID + " failed: " + err.Error())
+			continue
+		}
+		log.Println("Zone " + cf.zoneID + " done")
+	}
+	return errors.Join(errs...)
+}
+
+// moveRecords changes specified A or CNAME records from sourceIP to targetIP in every zone,
+// planned switch drains clients first when graceful mode is on. It returns the full names of the changed records
+func (c *cfConfig) moveRecords(ctx context.Context, sourceIP, targetIP string, planned bool) ([]string, error) {
+	changed := map[string]bool{}
+	err := c.eachZone(ctx, func(cf *cfAccount) error {
+		names, err := c.moveZoneRecords(ctx, cf, sourceIP, targetIP, planned)
+		for _, name := range names {
+			// DR zones have records of the same names
+			changed[name] = true
+		}
+		return err
+	})
+	names := make([]string, 0, len(changed))
+	for name := range changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, err
+}
+
+// staleRecords returns the records, which differ from the target and are not updated recently,
+// and the full names of the out of date records, which are updated recently. Each name has its own cooldown,
+// errRecently is returned, when no out of date record may be changed
+func (c *cfConfig) staleRecords(cf *cfAccount, recordType string, records map[string]cfRecord, target string) (map[string]cfRecord, []string, error) {
+	stale := map[string]cfRecord{}
+	var recent []string
+	for name, r := range records {
+		if isContentEqual(r.content, target) {
+			// the name is edited independently and is already right
+			continue
+		}
+		if time.Since(r.modified) < c.cooldown {
+			recent = append(recent, cf.fullName(name))
+			continue
+		}
+		stale[name] = r
+	}
+	sort.Strings(recent)
+	if len(recent) > 0 {
+		log.Println("Skip " + recordType + " " + strings.Join(recent, ", ") + ", updated recently")
+	}
+	if len(stale) == 0 && len(recent) > 0 {
+		return nil, recent, errRecently
+	}
+	return stale, recent, nil
+}
+
+// recordNames returns the sorted full names of the records
+func (cf *cfAccount) recordNames(records map[string]cfRecord) []string {
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, cf.fullName(name))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// moveZoneRecords changes specified A or CNAME records of the zone from sourceIP to targetIP,
+// the record type is changed, when the target is a host name or an IP of a previous host name.
+// It returns the full names of the changed records, a partialSwitchError, when some out of date records are not changed
+func (c *cfConfig) moveZoneRecords(ctx context.Context, cf *cfAccount, sourceIP, targetIP string, planned bool) ([]string, error) {
+	records, loadedType, err := cf.loadTargetRecords(ctx, cf.names)
+	if err != nil {
+		return nil, err
+	}
+	if sourceIP != "" && !isContentEqual(records["@"].content, sourceIP) {
+		return nil, errors.New("stated IP is " + records["@"].content)
 	}
-	if time.Since(records["@"].modified) < 10*time.Minute {
-		return errors.New("record updated recently")
+	records, skipped, err := c.staleRecords(cf, "A", records, targetIP)
+	if err != nil {
+		return nil, err
+	}
+	targetType := contentType(targetIP)
+	if targetType == "CNAME" {
+		// a CNAME record is not allowed beside other records of the name
+		if err := c.deleteZoneRecordsIPv6(ctx, cf); err != nil {
+			return nil, err
+		}
+	}
+	if planned && c.graceful && !c.dryRun {
+		err = c.drainRecords(ctx, cf, targetIP, loadedType, records)
+	} else {
+		err = cf.setRecords(ctx, targetIP, targetType, records)
 	}
-	return cf.setRecords(targetIP, "A", records)
+	if err != nil {
+		return nil, err
+	}
+	if targetType != "CNAME" {
+		if err := cf.ensurePinned(ctx, "A"); err != nil {
+			return nil, err
+		}
+	}
+	changed := cf.recordNames(records)
+	if len(skipped) > 0 {
+		// clients of the skipped names still go to the source
+		return changed, &partialSwitchError{recordType: "A", changed: changed, skipped: skipped}
+	}
+	return changed, nil
 }
 
-// moveRecordsIPv6 changes specified AAAA records from sourceIPv6 to targetIPv6
-func (c *cfConfig) moveRecordsIPv6(sourceIPv6, targetIPv6 string) error {
-	cf := c.newAccount()
-	if err := cf.loadZone(); err != nil {
+// deleteZoneRecordsIPv6 deletes AAAA records of the names in the zone, when there are some
+func (c *cfConfig) deleteZoneRecordsIPv6(ctx context.Context, cf *cfAccount) error {
+	records, err := cf.loadRecords(ctx, cf.names, "AAAA")
+	if err == errNotFound {
+		return nil
+	}
+	if err != nil {
 		return err
 	}
-	records, err := cf.loadRecords(cf.names, "AAAA")
+	if err := c.deletes.allow(len(records)); err != nil {
+		return err
+	}
+	return cf.deleteRecords(ctx, "AAAA", records)
+}
+
+// actualRecords reads the A or CNAME and AAAA record contents of the domain, the content is blank when there is no record
+func (c *cfConfig) actualRecords(ctx context.Context) (string, string, error) {
+	cf, err := c.domainAccount(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	records, _, err := cf.loadTargetRecords(ctx, []string{"@"})
+	if err != nil && err != errNotFound {
+		return "", "", err
+	}
+	if c.noIPv6 {
+		return records["@"].content, "", nil
+	}
+	recordsIPv6, err := cf.loadRecords(ctx, []string{"@"}, "AAAA")
+	if err != nil && err != errNotFound {
+		return "", "", err
+	}
+	return records["@"].content, recordsIPv6["@"].content, nil
+}
+
+// moveRecordsIPv6 changes specified AAAA records from sourceIPv6 to targetIPv6 in every zone
+func (c *cfConfig) moveRecordsIPv6(ctx context.Context, sourceIPv6, targetIPv6 string) error {
+	return c.eachZone(ctx, func(cf *cfAccount) error {
+		return c.moveZoneRecordsIPv6(ctx, cf, targetIPv6)
+	})
+}
+
+// loadExisting reads zone records of the names, that have a record of the type, other names are logged as skipped
+func (cf *cfAccount) loadExisting(ctx context.Context, recordType string) (map[string]cfRecord, error) {
+	var names []string
+	for _, name := range cf.names {
+		list, err := cf.listRecords(ctx, name, recordType)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, r := range list {
+			found = found || !cf.isPinned(name, r.content)
+		}
+		if !found {
+			log.Println("Skip " + recordType + " " + cf.fullName(name) + ", there is no record, createmissing=false")
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return map[string]cfRecord{}, nil
+	}
+	return cf.loadRecords(ctx, names, recordType)
+}
+
+// moveZoneRecordsIPv6 changes specified AAAA records of the zone to targetIPv6
+func (c *cfConfig) moveZoneRecordsIPv6(ctx context.Context, cf *cfAccount, targetIPv6 string) error {
+	records, err := cf.loadRecords(ctx, cf.names, "AAAA")
+	if err == errNotFound && targetIPv6 != "" && c.skipMissing {
+		// missing records are not created
+		if records, err = cf.loadExisting(ctx, "AAAA"); err == nil && len(records) == 0 {
+			return nil
+		}
+	}
 	if err != nil && err != errNotFound {
 		return err
 	}
 	if err == errNotFound {
 		// no any records detected
 		if targetIPv6 != "" {
-			return cf.createRecords(targetIPv6, "AAAA", cf.names)
+			if err := cf.createRecords(ctx, targetIPv6, "AAAA", cf.names); err != nil {
+				return err
+			}
+			return cf.ensurePinned(ctx, "AAAA")
 		}
 		// else source and targets are blank
 	} else {
 		// records detected
 		if targetIPv6 != "" {
 			// update
-			if time.Since(records["@"].modified) < 10*time.Minute {
-				return errors.New("record updated recently")
+			records, skipped, err := c.staleRecords(cf, "AAAA", records, targetIPv6)
+			if err != nil {
+				return err
+			}
+			if err := cf.setRecords(ctx, targetIPv6, "AAAA", records); err != nil {
+				return err
 			}
-			return cf.setRecords(targetIPv6, "AAAA", records)
+			if err := cf.ensurePinned(ctx, "AAAA"); err != nil {
+				return err
+			}
+			if len(skipped) > 0 {
+				return &partialSwitchError{recordType: "AAAA", changed: cf.recordNames(records), skipped: skipped}
+			}
+			return nil
 		}
 		// else delete
-		return cf.deleteRecords("AAAA", records)
+		if err := c.deletes.allow(len(records)); err != nil {
+			return err
+		}
+		return cf.deleteRecords(ctx, "AAAA", records)
 	}
 	return nil
 }
 
-func newCFConfig(ini *inifile.IniFile) *cfConfig {
-	return &cfConfig{
-		ini: ini,
+// isBlank reports whether the domain zone has no A, AAAA and CNAME records of the names, pinned records are not counted
+func (c *cfConfig) isBlank(ctx context.Context) (bool, error) {
+	cf, err := c.domainAccount(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, recordType := range []string{"A", "AAAA", "CNAME"} {
+		for _, name := range cf.names {
+			list, err := cf.listRecords(ctx, name, recordType)
+			if err != nil {
+				return false, err
+			}
+			for _, r := range list {
+				if !cf.isPinned(name, r.content) {
+					return false, nil
+				}
+			}
+		}
+	}
+	return true, nil
+}
+
+// bootstrapRecords creates A or CNAME records and, when the IPv6 is not blank, AAAA records in every zone
+func (c *cfConfig) bootstrapRecords(ctx context.Context, ip, ipv6 string) error {
+	return c.eachZone(ctx, func(cf *cfAccount) error {
+		if err := cf.createRecords(ctx, ip, contentType(ip), cf.names); err != nil {
+			return err
+		}
+		if contentType(ip) == "CNAME" {
+			return nil
+		}
+		if err := cf.ensurePinned(ctx, "A"); err != nil {
+			return err
+		}
+		if ipv6 == "" {
+			return nil
+		}
+		if err := cf.createRecords(ctx, ipv6, "AAAA", cf.names); err != nil {
+			return err
+		}
+		return cf.ensurePinned(ctx, "AAAA")
+	})
+}
+
+// pinnedContents returns pinned record contents of the name
+func (c *cfConfig) pinnedContents(name string) []string {
+	return c.pinned[name]
+}
+
+// switchWait returns the drain wait of the graceful switch
+func (c *cfConfig) switchWait() time.Duration {
+	if !c.graceful {
+		return 0
+	}
+	return c.drainWait
+}
+
+// reconcileRecords makes A records of the names point to exactly the targets in every zone.
+// Records to delete are counted in all zones before any change, so the maxdelete limit aborts the whole reconcile
+func (c *cfConfig) reconcileRecords(ctx context.Context, targets []string) error {
+	accounts, err := c.zoneAccounts(ctx)
+	if err != nil {
+		return err
+	}
+	plans := map[string][]cfNameChanges{}
+	deletes := 0
+	for _, cf := range accounts {
+		changes, n, err := cf.planReconcile(ctx, targets)
+		if err != nil {
+			return &zoneError{zoneID: cf.zoneID, err: err}
+		}
+		plans[cf.zoneID] = changes
+		deletes += n
+	}
+	if deletes > 0 {
+		if err := c.deletes.allow(deletes); err != nil {
+			return err
+		}
+	}
+	return c.eachZone(ctx, func(cf *cfAccount) error {
+		return cf.applyReconcile(ctx, plans[cf.zoneID])
+	})
+}
+
+// Round robin changes of a name, records of missing targets are created, records of other IPs are deleted
+type cfNameChanges struct {
+	name    string
+	creates []string
+	deletes []cfRecord
+}
+
+// planReconcile returns changes, that make A records of the names point to exactly the targets,
+// and the number of records to delete. Pinned records are kept
+func (cf *cfAccount) planReconcile(ctx context.Context, targets []string) ([]cfNameChanges, int, error) {
+	var changes []cfNameChanges
+	deletes := 0
+	for _, name := range cf.names {
+		list, err := cf.listRecords(ctx, name, "A")
+		if err != nil {
+			return nil, 0, err
+		}
+		change := cfNameChanges{name: name}
+		for _, target := range targets {
+			found := false
+			for _, r := range list {
+				if isAddrEqual(r.content, target) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				change.creates = append(change.creates, target)
+			}
+		}
+		for _, r := range list {
+			if !cf.isPinned(name, r.content) && !isSkipped(r.content, targets) {
+				change.deletes = append(change.deletes, r)
+			}
+		}
+		deletes += len(change.deletes)
+		changes = append(changes, change)
+	}
+	return changes, deletes, nil
+}
+
+// applyReconcile creates records of missing targets and then deletes records of other IPs,
+// so a name never has no record
+func (cf *cfAccount) applyReconcile(ctx context.Context, changes []cfNameChanges) error {
+	for _, change := range changes {
+		for _, target := range change.creates {
+			if err := cf.createRecords(ctx, target, "A", []string{change.name}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, change := range changes {
+		for _, r := range change.deletes {
+			if err := cf.deleteRecords(ctx, "A", map[string]cfRecord{change.name: r}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// describeRecords returns the content, TTL, proxy status and modification time of every managed record
+// of the domain zone, pinned records included
+func (c *cfConfig) describeRecords(ctx context.Context) ([]string, error) {
+	cf, err := c.domainAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, recordType := range []string{"A", "AAAA", "CNAME"} {
+		for _, name := range cf.names {
+			list, err := cf.listRecords(ctx, name, recordType)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range list {
+				lines = append(lines, recordType+" "+cf.fullName(name)+" "+r.content+
+					" ttl "+strconv.Itoa(r.ttl)+" proxied "+strconv.FormatBool(r.proxied)+
+					" modified "+r.modified.Format(time.RFC3339))
+			}
+		}
+	}
+	return lines, nil
+}
+
+// writeText creates or changes the TXT record of the name in the domain zone
+func (c *cfConfig) writeText(ctx context.Context, name, content string) error {
+	cf, err := c.domainAccount(ctx)
+	if err != nil {
+		return err
+	}
+	records, err := cf.loadRecords(ctx, []string{name}, "TXT")
+	if err == errNotFound {
+		return cf.createRecords(ctx, content, "TXT", []string{name})
+	}
+	if err != nil {
+		return err
+	}
+	return cf.setRecords(ctx, content, "TXT", records)
+}
+
+// newCycle starts counting of watch cycle changes
+func (c *cfConfig) newCycle() {
+	c.deletes.count = 0
+}
+
+func newCFConfig(ini iniFile, domain string, names []string) (*cfConfig, error) {
+	d := newDurationReader(ini)
+	c := &cfConfig{
+		ini:          ini,
+		domain:       domain,
+		names:        names,
+		pinned:       parsePinned(ini.Get("", "pinned")),
+		graceful:     strings.ToLower(ini.Get("", "graceful")) == "true",
+		drainTTL:     int(d.get("drainttl", 30, time.Second) / time.Second),
+		drainWait:    d.get("drainwait", 300, time.Second),
+		drainRestore: strings.ToLower(ini.Get("", "drainrestore")) == "true",
+		dryRun:       strings.ToLower(ini.Get("", "dryrun")) == "true",
+		noIPv6:       strings.ToLower(ini.Get("", "ipv6")) == "false",
+		skipMissing:  strings.ToLower(ini.Get("", "createmissing")) == "false",
+		batchWindow:  d.get("batchwindow", 0, time.Millisecond),
+		maxWait:      d.get("ratelimitwait", 60, time.Second),
+		recordTTL:    int(d.get("recordttl", 0, time.Second) / time.Second),
+		proxied:      map[string]bool{},
+	}
+	for _, name := range strings.Split(ini.Get("", "proxied"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			c.proxied[name] = true
+		}
+	}
+	c.retries = 3
+	if value := ini.Get("", "ratelimitretries"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, errors.New("ratelimitretries=" + value + " is not a number")
+		}
+		c.retries = n
+	}
+	c.writes = 3
+	if value := ini.Get("", "writeretries"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, errors.New("writeretries=" + value + " is not a number")
+		}
+		c.writes = n
+	}
+	c.bulkList = 5
+	if value := ini.Get("", "bulklist"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, errors.New("bulklist=" + value + " is not a number")
+		}
+		c.bulkList = n
+	}
+	c.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		// the timeout includes the response body read
+		Timeout: d.apiTimeout(),
+	}
+	for _, zoneID := range strings.Split(ini.Get("", "zones"), ",") {
+		if zoneID = strings.TrimSpace(zoneID); zoneID != "" {
+			c.zones = append(c.zones, zoneID)
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	// the zone lookup is skipped
+	if c.zoneID = strings.TrimSpace(ini.Get("", "zoneid."+domain)); c.zoneID == "" {
+		c.zoneID = strings.TrimSpace(ini.Get("", "zoneid"))
+	}
+	if c.batchWindow > 0 {
+		c.batches = map[string]*cfBatch{}
+	}
+	var err error
+	if c.cooldown, err = readCooldown(ini); err != nil {
+		return nil, err
+	}
+	if _, err := c.newAccount(); err != nil {
+		return nil, err
+	}
+	if d.debug {
+		for _, pair := range cfCredentials {
+			if value, source := credential(ini, pair[0], pair[1]); value != "" {
+				log.Println("debug: CloudFlare " + pair[0] + " is read from " + source)
+			}
+		}
+	}
+	if c.deletes, err = readDeleteLimit(ini); err != nil {
+		return nil, err
 	}
+	return c, nil
 }
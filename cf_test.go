@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Zone record of the test CloudFlare API
+type fakeRecord struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Content  string `json:"content"`
+	TTL      int    `json:"ttl"`
+	Proxied  bool   `json:"proxied"`
+	Modified string `json:"modified_on"`
+}
+
+// Test CloudFlare API of the zone1 zone, records are kept in memory
+type fakeZone struct {
+	mu      sync.Mutex
+	records []fakeRecord
+	lastID  int
+}
+
+// fakeModified is the change time of records, that are not changed recently
+const fakeModified = "2000-01-01T00:00:00Z"
+
+// add saves the record to the zone
+func (z *fakeZone) add(r fakeRecord) {
+	z.lastID++
+	r.ID = "r" + strconv.Itoa(z.lastID)
+	if r.Modified == "" {
+		r.Modified = fakeModified
+	}
+	z.records = append(z.records, r)
+}
+
+// find returns records of the type and the full name
+func (z *fakeZone) find(recordType, name string) []fakeRecord {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	var found []fakeRecord
+	for _, r := range z.records {
+		if r.Type == recordType && r.Name == name {
+			found = append(found, r)
+		}
+	}
+	return found
+}
+
+// reply writes the CloudFlare response of the result, or the error, when the code is not 0
+func reply(w http.ResponseWriter, result interface{}, code int) {
+	if code != 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"errors":  []map[string]interface{}{{"code": code, "message": "error " + strconv.Itoa(code)}},
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"result":      result,
+		"result_info": map[string]int{"total_pages": 1},
+	})
+}
+
+func (z *fakeZone) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	const prefix = "/zones/zone1/dns_records"
+	if r.URL.Path == "/zones" {
+		reply(w, []map[string]string{{"id": "zone1"}}, 0)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	var body fakeRecord
+	if r.Method == "POST" || r.Method == "PUT" {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		found := []fakeRecord{}
+		for _, record := range z.records {
+			if record.Type == query.Get("type") && (query.Get("name") == "" || record.Name == query.Get("name")) {
+				found = append(found, record)
+			}
+		}
+		reply(w, found, 0)
+	case "POST":
+		for _, record := range z.records {
+			if record.Type == body.Type && record.Name == body.Name {
+				if record.Content == body.Content {
+					reply(w, nil, cfIdenticalExists)
+				} else {
+					reply(w, nil, cfRecordExists)
+				}
+				return
+			}
+		}
+		z.add(body)
+		reply(w, z.records[len(z.records)-1], 0)
+	case "PUT":
+		for i := range z.records {
+			if z.records[i].ID == id {
+				body.ID, body.Modified = id, fakeModified
+				z.records[i] = body
+				reply(w, body, 0)
+				return
+			}
+		}
+		reply(w, nil, 81044)
+	case "DELETE":
+		for i := range z.records {
+			if z.records[i].ID == id {
+				z.records = append(z.records[:i], z.records[i+1:]...)
+				reply(w, map[string]string{"id": id}, 0)
+				return
+			}
+		}
+		reply(w, nil, 81044)
+	}
+}
+
+// newTestCF returns the CloudFlare provider of the names @ and www of example.com,
+// requests go to the handler, the text has extra main section keys
+func newTestCF(t *testing.T, handler http.Handler, text string) (*cfConfig, *cfAccount) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	ini := parseIni("apitoken = token\nzoneid = zone1\ncfbaseurl = " + server.URL + "\n" + text)
+	c, err := newCFConfig(ini, "example.com", []string{"@", "www"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := c.domainAccount(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, cf
+}
+
+func TestCreateExistingRecord(t *testing.T) {
+	zone := &fakeZone{}
+	// a concurrent run created the record
+	zone.add(fakeRecord{Type: "AAAA", Name: "www.example.com", Content: "2001:db8::1", TTL: 1})
+	_, cf := newTestCF(t, zone, "")
+	if err := cf.createRecords(context.Background(), "2001:db8::2", "AAAA", []string{"www"}); err != nil {
+		t.Fatal(err)
+	}
+	records := zone.find("AAAA", "www.example.com")
+	if len(records) != 1 || records[0].Content != "2001:db8::2" {
+		t.Fatalf("records are %+v, want one record of 2001:db8::2", records)
+	}
+	// the record is already as required
+	if err := cf.createRecords(context.Background(), "2001:db8::2", "AAAA", []string{"www"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPITimeout(t *testing.T) {
+	// the former cfapitimeout key is read, when apitimeout is missing
+	for _, key := range []string{"apitimeout", "cfapitimeout"} {
+		for _, headers := range []bool{false, true} {
+			headers := headers
+			// the API hangs longer than the timeout, before or after the response headers
+			_, cf := newTestCF(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if headers {
+					w.WriteHeader(http.StatusOK)
+					w.(http.Flusher).Flush()
+				}
+				select {
+				case <-r.Context().Done():
+				case <-time.After(10 * time.Second):
+				}
+			}), key+" = 1\n")
+			t0 := time.Now()
+			err := cf.loadZone(context.Background())
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				t.Fatalf("%s, headers %v: got error %v, want a timeout", key, headers, err)
+			}
+			if elapsed := time.Since(t0); elapsed > 5*time.Second {
+				t.Fatalf("%s, headers %v: request took %s, want the 1s timeout", key, headers, elapsed)
+			}
+		}
+	}
+}
+
+func TestRateLimitRetry(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	zone := &fakeZone{}
+	// the first request is rate limited
+	_, cf := newTestCF(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		limited := calls == 1
+		mu.Unlock()
+		if limited {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		zone.ServeHTTP(w, r)
+	}), "")
+	if err := cf.loadZone(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("got %d requests, want 2", calls)
+	}
+}
+
+func TestRateLimitExhausted(t *testing.T) {
+	_, cf := newTestCF(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}), "ratelimitretries = 2\n")
+	if err := cf.loadZone(context.Background()); err != errRateLimited {
+		t.Fatalf("got error %v, want errRateLimited", err)
+	}
+}
+
+func TestProxiedRecordKept(t *testing.T) {
+	zone := &fakeZone{}
+	zone.add(fakeRecord{Type: "A", Name: "example.com", Content: "192.0.2.1", TTL: 1, Proxied: true})
+	zone.add(fakeRecord{Type: "A", Name: "www.example.com", Content: "192.0.2.1", TTL: 1})
+	c, _ := newTestCF(t, zone, "")
+	names, err := c.moveRecords(context.Background(), "192.0.2.1", "192.0.2.2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "example.com,www.example.com" {
+		t.Errorf("changed names are %v", names)
+	}
+	for name, proxied := range map[string]bool{"example.com": true, "www.example.com": false} {
+		records := zone.find("A", name)
+		if len(records) != 1 || records[0].Content != "192.0.2.2" || records[0].Proxied != proxied {
+			t.Errorf("%s records are %+v, want 192.0.2.2 proxied %v", name, records, proxied)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// printConfig writes the parsed config of the domains to the standard output, secrets are masked
+func printConfig(filename string, cfgs []*config) {
+	fmt.Println("config " + filename)
+	for _, cfg := range cfgs {
+		for _, line := range cfg.describe() {
+			fmt.Println(logOutput.redact(line))
+		}
+	}
+}
+
+// redactURLs masks passwords of the comma separated URLs
+func redactURLs(value string) string {
+	urls := splitURLs(value)
+	for i, rawURL := range urls {
+		if u, err := url.Parse(rawURL); err == nil {
+			urls[i] = u.Redacted()
+		}
+	}
+	return strings.Join(urls, ",")
+}
+
+// describe returns lines of the domain config: durations, the check, the provider and nodes.
+// Credentials are listed by the source names, not by values
+func (cfg *config) describe() []string {
+	check := cfg.check
+	if check == "" {
+		check = "http"
+	}
+	if check == "http" || check == "http3" {
+		check += " " + cfg.checkMethod
+	}
+	lines := []string{
+		"domain " + cfg.domain,
+		"url " + redactURLs(cfg.watchURL),
+		"ttl " + cfg.ttl.String() + " jitter " + cfg.jitter.String(),
+		"timeout " + cfg.timeout.String(),
+		"check " + check,
+		"failthreshold " + strconv.Itoa(cfg.failThreshold) + " risethreshold " + strconv.Itoa(cfg.riseThreshold),
+	}
+	var provider string
+	var names []string
+	var credentials []string
+	switch c := cfg.dns.(type) {
+	case *cfConfig:
+		provider, names = "cloudflare", c.names
+		for _, pair := range cfCredentials {
+			if value, source := credential(c.ini, pair[0], pair[1]); value != "" {
+				credentials = append(credentials, source)
+			}
+		}
+	case *doConfig:
+		provider, names = "digitalocean", c.names
+		credentials = append(credentials, "dotoken")
+	}
+	lines = append(lines,
+		"provider "+provider+" names "+strings.Join(names, ","),
+		"credentials "+strings.Join(credentials, ","),
+	)
+	if cfg.dryRun {
+		lines = append(lines, "dryrun true")
+	}
+	for _, n := range cfg.nodes {
+		line := "node " + n.name
+		for _, field := range [][2]string{{"ip", n.ip}, {"ipv6", n.ipv6}, {"vip", n.vip}, {"cname", n.cname}, {"domain", n.zone}, {"url", redactURLs(n.url)}} {
+			if field[1] != "" {
+				line += " " + field[0] + " " + field[1]
+			}
+		}
+		line += " weight " + strconv.Itoa(n.weight) + " priority " + strconv.Itoa(n.priority)
+		lines = append(lines, line)
+	}
+	return lines
+}
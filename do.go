@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DigitalOcean domain record
+type doRecord struct {
+	ID   int    `json:"id,omitempty"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Data string `json:"data"`
+	TTL  int    `json:"ttl,omitempty"`
+}
+
+// DigitalOcean config
+type doConfig struct {
+	token     string
+	domain    string
+	names     []string
+	pinned    map[string][]string
+	client    *http.Client
+	dryRun    bool
+	changed   map[string]time.Time // last change of the records by type, DigitalOcean keeps no change time
+	cooldown  time.Duration
+	recordTTL int  // TTL of switched and created records, 0 to keep the loaded TTL
+	noIPv6    bool // AAAA records are not read
+	// AAAA records are changed for the names with a record only, no record is created
+	skipMissing bool
+	deletes     deleteLimit
+}
+
+// DigitalOcean API error response
+type doError struct {
+	status  int
+	ID      string
+	Message string
+}
+
+// Error returns the error ID and message of the response, or the HTTP status text
+func (e *doError) Error() string {
+	if e.ID == "" {
+		return http.StatusText(e.status)
+	}
+	return "digitalocean: " + e.ID + " " + e.Message
+}
+
+// doPageSize is the number of records of a list page
+const doPageSize = 200
+
+// request parses the DigitalOcean response
+func (c *doConfig) request(ctx context.Context, method, url string, body interface{}, v interface{}) error {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		reqBody = nil
+	}
+	url = "https://api.digitalocean.com/v2/domains/" + c.domain + "/records" + url
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+c.token)
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		metrics.apiError("digitalocean")
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		metrics.apiError("digitalocean")
+		doErr := &doError{status: resp.StatusCode}
+		json.Unmarshal(data, doErr) // the status is enough, when the body is not parsed
+		return doErr
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// fullName returns the domain name of the record
+func (c *doConfig) fullName(name string) string {
+	if name == "@" {
+		return c.domain
+	}
+	return name + "." + c.domain
+}
+
+// isPinned reports whether the record content is pinned for the name
+func (c *doConfig) isPinned(name string, content string) bool {
+	for _, pinned := range c.pinned[name] {
+		if isAddrEqual(pinned, content) {
+			return true
+		}
+	}
+	return false
+}
+
+// listRecords reads all domain records of the name page by page
+func (c *doConfig) listRecords(ctx context.Context, name string, recordType string) ([]doRecord, error) {
+	var records []doRecord
+	for page := 1; ; page++ {
+		url := "?type=" + recordType + "&name=" + c.fullName(name) +
+			"&per_page=" + strconv.Itoa(doPageSize) + "&page=" + strconv.Itoa(page)
+		var list struct {
+			DomainRecords []doRecord `json:"domain_records"`
+		}
+		if err := c.request(ctx, "GET", url, nil, &list); err != nil {
+			return nil, err
+		}
+		records = append(records, list.DomainRecords...)
+		if len(list.DomainRecords) < doPageSize {
+			return records, nil
+		}
+	}
+}
+
+// loadRecords reads domain records of the names, pinned records are skipped.
+// Duplicate records of a name are an error, so a wrong record is never changed
+func (c *doConfig) loadRecords(ctx context.Context, names []string, recordType string) (map[string]doRecord, error) {
+	records := map[string]doRecord{}
+	for _, name := range names {
+		list, err := c.listRecords(ctx, name, recordType)
+		if err != nil {
+			return nil, err
+		}
+		found := 0
+		for _, r := range list {
+			if !c.isPinned(name, r.Data) {
+				records[name] = r
+				found++
+			}
+		}
+		if found == 0 {
+			return nil, errNotFound
+		}
+		if found > 1 {
+			return nil, errors.New(strconv.Itoa(found) + " " + recordType + " records of " + c.fullName(name) +
+				" found, expected one, remove duplicates or pin them")
+		}
+	}
+	return records, nil
+}
+
+// setRecords changes previosly loaded domain records to a new IP, the records TTL is kept
+func (c *doConfig) setRecords(ctx context.Context, ip string, recordType string, records map[string]doRecord) error {
+	for name, r := range records {
+		if c.dryRun {
+			log.Println("Dry run: set " + recordType + " " + c.fullName(name) + " " + r.Data + " to " + ip)
+			continue
+		}
+		body := &doRecord{
+			Type: r.Type,
+			Name: r.Name,
+			Data: ip,
+			TTL:  r.TTL,
+		}
+		if c.recordTTL != 0 {
+			body.TTL = c.recordTTL
+		}
+		var record struct {
+			DomainRecord doRecord `json:"domain_record"`
+		}
+		if err := c.request(ctx, "PUT", "/"+strconv.Itoa(r.ID), body, &record); err != nil {
+			return err
+		}
+		if !isContentEqual(record.DomainRecord.Data, ip) {
+			return errors.New("set record " + c.fullName(name) + " to " + ip + " error, still " + record.DomainRecord.Data)
+		}
+	}
+	c.changed[recordType] = time.Now()
+	return nil
+}
+
+// createRecords creates domain records
+func (c *doConfig) createRecords(ctx context.Context, ip string, recordType string, names []string) error {
+	for _, name := range names {
+		if c.dryRun {
+			log.Println("Dry run: create " + recordType + " " + c.fullName(name) + " " + ip)
+			continue
+		}
+		body := &doRecord{
+			Type: recordType,
+			Name: name,
+			Data: ip,
+			TTL:  c.recordTTL,
+		}
+		var record struct{}
+		if err := c.request(ctx, "POST", "", body, &record); err != nil {
+			return err
+		}
+	}
+	c.changed[recordType] = time.Now()
+	return nil
+}
+
+// deleteRecords deletes domain records, pinned records are never deleted
+func (c *doConfig) deleteRecords(ctx context.Context, recordType string, records map[string]doRecord) error {
+	for name, r := range records {
+		if c.isPinned(name, r.Data) {
+			continue
+		}
+		if c.dryRun {
+			log.Println("Dry run: delete " + recordType + " " + c.fullName(name) + " " + r.Data)
+			continue
+		}
+		var record struct{}
+		if err := c.request(ctx, "DELETE", "/"+strconv.Itoa(r.ID), nil, &record); err != nil {
+			return err
+		}
+	}
+	c.changed[recordType] = time.Now()
+	return nil
+}
+
+// isRecent reports whether the records of the type were changed during the cooldown
+func (c *doConfig) isRecent(recordType string) bool {
+	return time.Since(c.changed[recordType]) < c.cooldown
+}
+
+// newCycle starts counting of watch cycle changes
+func (c *doConfig) newCycle() {
+	c.deletes.count = 0
+}
+
+// Round robin changes of a name, records of missing targets are created, records of other IPs are deleted
+type doNameChanges struct {
+	name    string
+	creates []string
+	deletes []doRecord
+}
+
+// reconcileRecords creates A records of missing targets and then deletes records of other IPs,
+// so a name never has no record. Pinned records are kept.
+// Records to delete are counted before any change, so the maxdelete limit aborts the whole reconcile
+func (c *doConfig) reconcileRecords(ctx context.Context, targets []string) error {
+	var changes []doNameChanges
+	deletes := 0
+	for _, name := range c.names {
+		list, err := c.listRecords(ctx, name, "A")
+		if err != nil {
+			return err
+		}
+		change := doNameChanges{name: name}
+		for _, target := range targets {
+			found := false
+			for _, r := range list {
+				if isAddrEqual(r.Data, target) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				change.creates = append(change.creates, target)
+			}
+		}
+		for _, r := range list {
+			if !c.isPinned(name, r.Data) && !isSkipped(r.Data, targets) {
+				change.deletes = append(change.deletes, r)
+			}
+		}
+		deletes += len(change.deletes)
+		changes = append(changes, change)
+	}
+	if deletes > 0 {
+		if err := c.deletes.allow(deletes); err != nil {
+			return err
+		}
+	}
+	for _, change := range changes {
+		for _, target := range change.creates {
+			if err := c.createRecords(ctx, target, "A", []string{change.name}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, change := range changes {
+		for _, r := range change.deletes {
+			if err := c.deleteRecords(ctx, "A", map[string]doRecord{change.name: r}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeText creates or changes the TXT record of the name
+func (c *doConfig) writeText(ctx context.Context, name, content string) error {
+	records, err := c.loadRecords(ctx, []string{name}, "TXT")
+	if err == errNotFound {
+		return c.createRecords(ctx, content, "TXT", []string{name})
+	}
+	if err != nil {
+		return err
+	}
+	return c.setRecords(ctx, content, "TXT", records)
+}
+
+// describeRecords returns the content and TTL of every managed record of the domain, pinned records included
+func (c *doConfig) describeRecords(ctx context.Context) ([]string, error) {
+	var lines []string
+	for _, recordType := range []string{"A", "AAAA"} {
+		for _, name := range c.names {
+			list, err := c.listRecords(ctx, name, recordType)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range list {
+				lines = append(lines, recordType+" "+c.fullName(name)+" "+r.Data+" ttl "+strconv.Itoa(r.TTL))
+			}
+		}
+	}
+	return lines, nil
+}
+
+// actualRecords reads the A and AAAA record contents of the domain, the content is blank when there is no record
+func (c *doConfig) actualRecords(ctx context.Context) (string, string, error) {
+	var contents []string
+	for _, recordType := range []string{"A", "AAAA"} {
+		if recordType == "AAAA" && c.noIPv6 {
+			contents = append(contents, "")
+			continue
+		}
+		records, err := c.loadRecords(ctx, []string{"@"}, recordType)
+		if err != nil && err != errNotFound {
+			return "", "", err
+		}
+		contents = append(contents, records["@"].Data)
+	}
+	return contents[0], contents[1], nil
+}
+
+// moveRecords changes specified A records from sourceIP to targetIP, it returns the full names of the changed records,
+// records, which already point to the target, are not changed
+func (c *doConfig) moveRecords(ctx context.Context, sourceIP, targetIP string, planned bool) ([]string, error) {
+	records, err := c.loadRecords(ctx, c.names, "A")
+	if err != nil {
+		return nil, err
+	}
+	if sourceIP != "" && !isAddrEqual(records["@"].Data, sourceIP) {
+		return nil, errors.New("stated IP is " + records["@"].Data)
+	}
+	if c.isRecent("A") {
+		return nil, errRecently
+	}
+	stale := map[string]doRecord{}
+	for name, r := range records {
+		// a record may already point to the target
+		if !isContentEqual(r.Data, targetIP) {
+			stale[name] = r
+		}
+	}
+	if len(stale) == 0 {
+		return nil, nil
+	}
+	if err := c.setRecords(ctx, targetIP, "A", stale); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(stale))
+	for name := range stale {
+		names = append(names, c.fullName(name))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// loadExisting reads domain records of the names, that have a record of the type, other names are logged as skipped
+func (c *doConfig) loadExisting(ctx context.Context, recordType string) (map[string]doRecord, error) {
+	var names []string
+	for _, name := range c.names {
+		list, err := c.listRecords(ctx, name, recordType)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, r := range list {
+			found = found || !c.isPinned(name, r.Data)
+		}
+		if !found {
+			log.Println("Skip " + recordType + " " + c.fullName(name) + ", there is no record, createmissing=false")
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return map[string]doRecord{}, nil
+	}
+	return c.loadRecords(ctx, names, recordType)
+}
+
+// moveRecordsIPv6 changes specified AAAA records from sourceIPv6 to targetIPv6
+func (c *doConfig) moveRecordsIPv6(ctx context.Context, sourceIPv6, targetIPv6 string) error {
+	records, err := c.loadRecords(ctx, c.names, "AAAA")
+	if err == errNotFound && targetIPv6 != "" && c.skipMissing {
+		// missing records are not created
+		if records, err = c.loadExisting(ctx, "AAAA"); err == nil && len(records) == 0 {
+			return nil
+		}
+	}
+	if err != nil && err != errNotFound {
+		return err
+	}
+	if err == errNotFound {
+		// no any records detected
+		if targetIPv6 != "" {
+			return c.createRecords(ctx, targetIPv6, "AAAA", c.names)
+		}
+		return nil
+	}
+	if targetIPv6 != "" {
+		if c.isRecent("AAAA") {
+			return errRecently
+		}
+		return c.setRecords(ctx, targetIPv6, "AAAA", records)
+	}
+	if err := c.deletes.allow(len(records)); err != nil {
+		return err
+	}
+	return c.deleteRecords(ctx, "AAAA", records)
+}
+
+// isBlank reports whether the domain has no A and AAAA records of the names, pinned records are not counted
+func (c *doConfig) isBlank(ctx context.Context) (bool, error) {
+	for _, recordType := range []string{"A", "AAAA"} {
+		for _, name := range c.names {
+			list, err := c.listRecords(ctx, name, recordType)
+			if err != nil {
+				return false, err
+			}
+			for _, r := range list {
+				if !c.isPinned(name, r.Data) {
+					return false, nil
+				}
+			}
+		}
+	}
+	return true, nil
+}
+
+// bootstrapRecords creates A records and, when the IPv6 is not blank, AAAA records
+func (c *doConfig) bootstrapRecords(ctx context.Context, ip, ipv6 string) error {
+	if err := c.createRecords(ctx, ip, "A", c.names); err != nil {
+		return err
+	}
+	if ipv6 == "" {
+		return nil
+	}
+	return c.createRecords(ctx, ipv6, "AAAA", c.names)
+}
+
+// flush does nothing, changes are applied at once
+func (c *doConfig) flush(ctx context.Context) error {
+	return nil
+}
+
+// pinnedContents returns pinned record contents of the name
+func (c *doConfig) pinnedContents(name string) []string {
+	return c.pinned[name]
+}
+
+// switchWait returns no extra time, there is no graceful switch
+func (c *doConfig) switchWait() time.Duration {
+	return 0
+}
+
+func newDOConfig(ini iniFile, domain string, names []string) (*doConfig, error) {
+	c := &doConfig{
+		token:   ini.Get("", "dotoken"),
+		domain:  domain,
+		names:   names,
+		pinned:  parsePinned(ini.Get("", "pinned")),
+		dryRun:  strings.ToLower(ini.Get("", "dryrun")) == "true",
+		changed: map[string]time.Time{},
+		noIPv6:  strings.ToLower(ini.Get("", "ipv6")) == "false",
+	}
+	c.skipMissing = strings.ToLower(ini.Get("", "createmissing")) == "false"
+	if c.token == "" || c.domain == "" {
+		return nil, errors.New("DigitalOcean credentials are missing, set dotoken and domain")
+	}
+	var err error
+	if c.cooldown, err = readCooldown(ini); err != nil {
+		return nil, err
+	}
+	d := newDurationReader(ini)
+	c.client = &http.Client{
+		// the timeout includes the response body read
+		Timeout: d.apiTimeout(),
+	}
+	c.recordTTL = int(d.get("recordttl", 0, time.Second) / time.Second)
+	if d.err != nil {
+		return nil, d.err
+	}
+	if c.deletes, err = readDeleteLimit(ini); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
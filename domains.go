@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Node check results of the watch cycle, domains with the same nodes share checks
+type checkCache struct {
+	mu      sync.Mutex
+	results map[string]checkResult // by node address and URL
+}
+
+// reset drops results of the previous cycle
+func (c *checkCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results = map[string]checkResult{}
+}
+
+// checkShared checks the node once a cycle, the result is reused by other domains
+func (cfg *config) checkShared(ctx context.Context, n *node) checkResult {
+	addr, rawURL := n.addr(), cfg.nodeURL(n)
+	check := cfg.checkNode
+	if cfg.check == "srv" {
+		// the node is checked by its SRV record, not by the IP
+		addr = n.srv
+		check = cfg.checkSRV
+	}
+	if addr == "" {
+		// the host name of the node is not resolved
+		return checkResult{}
+	}
+	if cfg.checks == nil {
+		return check(ctx, addr, rawURL)
+	}
+	key := addr + " " + rawURL
+	cfg.checks.mu.Lock()
+	res, ok := cfg.checks.results[key]
+	cfg.checks.mu.Unlock()
+	if ok {
+		return res
+	}
+	res = check(ctx, addr, rawURL)
+	cfg.checks.mu.Lock()
+	if cfg.checks.results != nil {
+		cfg.checks.results[key] = res
+	}
+	cfg.checks.mu.Unlock()
+	return res
+}
+
+// splitDomains returns domain names of the comma separated list, a blank name for no domain
+func splitDomains(value string) []string {
+	var domains []string
+	for _, domain := range strings.Split(value, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) == 0 {
+		// validate reports the missing domain
+		return []string{""}
+	}
+	return domains
+}
+
+// domainFile returns the file name of the domain, the domain is added before the extension
+func domainFile(filename, domain string) string {
+	if filename == "" {
+		return ""
+	}
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "." + domain + ext
+}
+
+// validateDomains returns problems of all domains joined
+func validateDomains(cfgs []*config) error {
+	var problems []error
+	for _, cfg := range cfgs {
+		if err := cfg.validate(); err != nil {
+			if len(cfgs) > 1 {
+				err = errors.New("domain " + cfg.domain + ": " + err.Error())
+			}
+			problems = append(problems, err)
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// inheritDomains takes states of the running configs by domain name
+func inheritDomains(cfgs []*config, running []*config) {
+	for _, cfg := range cfgs {
+		for _, r := range running {
+			if r.domain == cfg.domain {
+				cfg.inherit(r)
+			}
+		}
+	}
+}
+
+// watchDomains runs the watch cycle of each domain, the error joins errors of all domains
+func watchDomains(ctx context.Context, cfgs []*config) error {
+	cfgs[0].checks.reset()
+	var errs []error
+	for _, cfg := range cfgs {
+		if err := cfg.watchCycle(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Node state transition, switch or error
+type event struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Node    string    `json:"node,omitempty"`
+	Message string    `json:"message"`
+}
+
+// Event fan-out to connected clients
+type eventHub struct {
+	mu      sync.Mutex
+	clients map[chan event]bool
+}
+
+// eventBuffer is the number of events a client may fall behind before disconnection
+const eventBuffer = 16
+
+var events = &eventHub{
+	clients: map[chan event]bool{},
+}
+
+// notify logs the message and sends it to event clients
+func notify(kind, node, message string) {
+	log.Println(message)
+	events.emit(kind, node, logOutput.redact(message))
+}
+
+// emit sends the event to every client, a client that does not keep up is disconnected
+func (h *eventHub) emit(kind, node, message string) {
+	e := event{
+		Time:    time.Now(),
+		Kind:    kind,
+		Node:    node,
+		Message: message,
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		select {
+		case c <- e:
+		default:
+			delete(h.clients, c)
+			close(c)
+		}
+	}
+}
+
+func (h *eventHub) subscribe() chan event {
+	c := make(chan event, eventBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = true
+	return c
+}
+
+func (h *eventHub) unsubscribe(c chan event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c)
+	}
+}
+
+// ServeHTTP streams events as Server-Sent Events
+func (h *eventHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	c := h.subscribe()
+	defer h.unsubscribe(c)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-c:
+			if !ok {
+				// client is too slow
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := w.Write([]byte("event: " + e.Kind + "\ndata: " + string(data) + "\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
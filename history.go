@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"strconv"
+)
+
+// Ring buffer of the last check results of a node
+type history struct {
+	results []bool
+	next    int  // index of the next result
+	full    bool // every result of the buffer is set
+}
+
+// add saves the check result, the oldest result is dropped when the buffer of the size is full
+func (h *history) add(ok bool, size int) {
+	if len(h.results) != size {
+		// the size is changed by a reload
+		*h = history{results: make([]bool, size)}
+	}
+	h.results[h.next] = ok
+	h.next++
+	if h.next == size {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// uptime returns the percentage of passed checks, false when there is no result
+func (h *history) uptime() (float64, bool) {
+	count := h.next
+	if h.full {
+		count = len(h.results)
+	}
+	if count == 0 {
+		return 0, false
+	}
+	passed := 0
+	for _, ok := range h.results[:count] {
+		if ok {
+			passed++
+		}
+	}
+	return float64(passed) * 100 / float64(count), true
+}
+
+// nodeUptime returns the uptime percentage of the node, nil when the history is off or empty
+func (cfg *config) nodeUptime(name string) *float64 {
+	s, ok := cfg.states[name]
+	if !ok || cfg.historySize == 0 {
+		return nil
+	}
+	uptime, ok := s.history.uptime()
+	if !ok {
+		return nil
+	}
+	return &uptime
+}
+
+// logHistory writes the uptime of every node every historysize cycles
+func (cfg *config) logHistory() {
+	if cfg.historySize == 0 {
+		return
+	}
+	cfg.cycles++
+	if cfg.cycles%cfg.historySize != 0 {
+		return
+	}
+	message := "Uptime of the last " + strconv.Itoa(cfg.historySize) + " cycles:"
+	for i, n := range cfg.nodes {
+		if i > 0 {
+			message += ","
+		}
+		message += " " + n.name
+		if uptime := cfg.nodeUptime(n.name); uptime != nil {
+			message += " " + strconv.FormatFloat(*uptime, 'f', 1, 64) + "%"
+		} else {
+			message += " unknown"
+		}
+	}
+	log.Println(message)
+}
@@ -0,0 +1,33 @@
+//go:build http3
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const http3Supported = true
+
+// newHTTP3Transport returns the QUIC transport connecting to the node IP
+func newHTTP3Transport(ip, serverName string) http.RoundTripper {
+	return &http3.RoundTripper{
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			if serverName != "" {
+				tlsCfg = tlsCfg.Clone()
+				tlsCfg.ServerName = serverName
+			}
+			// tlsCfg keeps the DNS name for the handshake, connect via IP
+			return quic.DialAddrEarly(ctx, ip+":"+port, tlsCfg, cfg)
+		},
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !http3
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+const http3Supported = false
+
+// errHTTP3 is returned when the HTTP/3 check is not compiled in
+var errHTTP3 = errors.New("HTTP/3 check is not supported by this build")
+
+type noHTTP3 struct{}
+
+func (noHTTP3) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errHTTP3
+}
+
+// newHTTP3Transport returns the transport failing every request
+func newHTTP3Transport(ip, serverName string) http.RoundTripper {
+	return noHTTP3{}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// HTTP endpoints by listen address, several endpoints may share an address
+var listeners = map[string]*http.ServeMux{}
+
+// handle registers the endpoint on the listen address
+func handle(addr, pattern string, handler http.Handler) {
+	mux, ok := listeners[addr]
+	if !ok {
+		mux = http.NewServeMux()
+		listeners[addr] = mux
+	}
+	mux.Handle(pattern, handler)
+}
+
+// serveListeners starts serving of registered endpoints
+func serveListeners() {
+	for addr, mux := range listeners {
+		go func(addr string, mux *http.ServeMux) {
+			log.Println(http.ListenAndServe(addr, mux))
+		}(addr, mux)
+	}
+}
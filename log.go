@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Log output, that truncates long lines and masks secrets
+type logFilter struct {
+	mu        sync.Mutex
+	out       io.Writer
+	maxLength int      // maximum line length, 0 for no limit
+	secrets   []string // values to mask
+	json      bool     // lines are JSON records, the message is truncated instead of the line
+}
+
+// defaultMaxLength is the maximum log line length by default
+const defaultMaxLength = 1000
+
+var logOutput = &logFilter{out: os.Stderr}
+
+// jsonLog is the structured log of the JSON format, nil for the text format
+var jsonLog *slog.Logger
+
+// Standard log output, that writes lines as JSON records
+type slogWriter struct{}
+
+func (slogWriter) Write(p []byte) (int, error) {
+	// a secret is masked before the cut, so no part of it is left
+	jsonLog.Info(logOutput.truncate(logOutput.redact(strings.TrimSuffix(string(p), "\n"))))
+	return len(p), nil
+}
+
+// configure sets the line length limit and secrets of the configuration
+func (f *logFilter) configure(ini iniFile) error {
+	maxLength := defaultMaxLength
+	if value := ini.Get("", "maxlogline"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return errors.New("maxlogline=" + value + " is not a number")
+		}
+		maxLength = n
+	}
+	var secrets []string
+	for _, key := range []string{"apikey", "apitoken", "dotoken", "smtppass", "checkauthpass", "checkbearer"} {
+		if value := ini.Get("", key); value != "" {
+			secrets = append(secrets, value)
+		}
+	}
+	for key, values := range readHeaders(ini) {
+		// credentials of the check request
+		if key == "Authorization" && values[0] != "" {
+			secrets = append(secrets, values[0])
+		}
+	}
+	for _, env := range []string{"AW_CF_APIKEY", "AW_CF_TOKEN"} {
+		if value := os.Getenv(env); value != "" {
+			secrets = append(secrets, value)
+		}
+	}
+	format := strings.ToLower(ini.Get("", "logformat"))
+	if format != "" && format != "text" && format != "json" {
+		return errors.New("unknown logformat " + format)
+	}
+	f.mu.Lock()
+	f.maxLength = maxLength
+	f.secrets = secrets
+	f.json = format == "json"
+	f.mu.Unlock()
+	if format == "json" {
+		jsonLog = slog.New(slog.NewJSONHandler(f, nil))
+		log.SetFlags(0)
+		log.SetOutput(slogWriter{})
+	} else if jsonLog != nil {
+		// the reloaded config is back to the text format
+		jsonLog = nil
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(f)
+	}
+	return nil
+}
+
+// redact masks secrets of the message
+func (f *logFilter) redact(message string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, secret := range f.secrets {
+		message = strings.ReplaceAll(message, secret, "****")
+	}
+	return message
+}
+
+// truncate cuts the line to the maximum length, an ellipsis marks the cut
+func (f *logFilter) truncate(line string) string {
+	f.mu.Lock()
+	maxLength := f.maxLength
+	f.mu.Unlock()
+	if maxLength == 0 || len(line) <= maxLength {
+		return line
+	}
+	cut := maxLength
+	for cut > 0 && !utf8.RuneStart(line[cut]) {
+		// do not split a multibyte character
+		cut--
+	}
+	return line[:cut] + "..."
+}
+
+// Write writes the redacted and truncated log line
+func (f *logFilter) Write(p []byte) (int, error) {
+	line := f.redact(strings.TrimSuffix(string(p), "\n"))
+	f.mu.Lock()
+	json := f.json
+	f.mu.Unlock()
+	if !json {
+		line = f.truncate(line)
+	}
+	if _, err := io.WriteString(f.out, line+"\n"); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logNode writes the node check result as a JSON record
+func logNode(n *node, res checkResult, up bool, actual bool) {
+	if jsonLog == nil {
+		return
+	}
+	jsonLog.Info("node", "node", n.name, "ip", n.ip, "up", up,
+		"latency_ms", res.latency.Milliseconds(), "actual", actual)
+}
+
+// logFailover writes the record switch as a JSON record
+func logFailover(recordType, from, to string) {
+	if jsonLog == nil {
+		return
+	}
+	jsonLog.Info("failover", "type", recordType, "from", from, "to", to)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTP settings of notification mails
+type mailer struct {
+	host string
+	port string
+	user string
+	pass string
+	from string
+	to   []string
+}
+
+// mailTimeout limits the mail delivery, so a slow server does not delay the watch cycle
+const mailTimeout = 10 * time.Second
+
+// newMailer returns the mail settings, nil when no SMTP host is set
+func newMailer(ini iniFile) (*mailer, error) {
+	m := &mailer{
+		host: ini.Get("", "smtphost"),
+		port: ini.Get("", "smtpport"),
+		user: ini.Get("", "smtpuser"),
+		pass: ini.Get("", "smtppass"),
+		from: ini.Get("", "mailfrom"),
+	}
+	if m.host == "" {
+		return nil, nil
+	}
+	if m.port == "" {
+		m.port = "25"
+	}
+	for _, to := range strings.Split(ini.Get("", "mailto"), ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			m.to = append(m.to, to)
+		}
+	}
+	if m.from == "" || len(m.to) == 0 {
+		return nil, errors.New("mail settings are missing, set mailfrom and mailto")
+	}
+	return m, nil
+}
+
+// send mails the message, a failure is logged only
+func (m *mailer) send(subject, body string) {
+	if m == nil {
+		return
+	}
+	if err := m.deliver(subject, body); err != nil {
+		log.Println("WARNING: mail: " + err.Error())
+	}
+}
+
+// deliver sends the mail by SMTP, STARTTLS is used when the server supports it
+func (m *mailer) deliver(subject, body string) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(m.host, m.port), mailTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(mailTimeout))
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+	if m.user != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.user, m.pass, m.host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	for _, to := range m.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	message := "From: " + m.from + "\r\n" +
+		"To: " + strings.Join(m.to, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body + "\r\n"
+	if _, err := w.Write([]byte(message)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
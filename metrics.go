@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus metrics of node checks, failovers and DNS provider API errors
+type metricSet struct {
+	mu        sync.Mutex
+	latency   map[string]time.Duration // last check latency by node name
+	up        map[string]bool          // last check result by node name
+	failovers map[string]int           // by IP family
+	apiErrors map[string]int           // by DNS provider
+}
+
+var metrics = &metricSet{
+	latency: map[string]time.Duration{},
+	up:      map[string]bool{},
+	failovers: map[string]int{
+		"ipv4": 0,
+		"ipv6": 0,
+	},
+	apiErrors: map[string]int{
+		"cloudflare":   0,
+		"digitalocean": 0,
+	},
+}
+
+// setNode saves the node check result
+func (m *metricSet) setNode(name string, res checkResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency[name] = res.latency
+	m.up[name] = res.ok
+}
+
+// failover counts the switch of IPv4 or IPv6 records
+func (m *metricSet) failover(family string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failovers[family]++
+}
+
+// apiError counts the failed API request of the DNS provider
+func (m *metricSet) apiError(provider string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apiErrors[provider]++
+}
+
+// labelValue escapes the label value of the text format
+var labelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ServeHTTP writes metrics in the Prometheus text format
+func (m *metricSet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.up))
+	for name := range m.up {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("# HELP aw_node_latency_milliseconds Last check latency of the node.\n")
+	b.WriteString("# TYPE aw_node_latency_milliseconds gauge\n")
+	for _, name := range names {
+		b.WriteString(`aw_node_latency_milliseconds{node="` + labelValue.Replace(name) + `"} ` +
+			strconv.FormatInt(int64(m.latency[name]/time.Millisecond), 10) + "\n")
+	}
+	b.WriteString("# HELP aw_node_up Last check result of the node, 1 is up.\n")
+	b.WriteString("# TYPE aw_node_up gauge\n")
+	for _, name := range names {
+		up := "0"
+		if m.up[name] {
+			up = "1"
+		}
+		b.WriteString(`aw_node_up{node="` + labelValue.Replace(name) + `"} ` + up + "\n")
+	}
+	b.WriteString("# HELP aw_failovers_total Switches of the records by IP family.\n")
+	b.WriteString("# TYPE aw_failovers_total counter\n")
+	for _, family := range []string{"ipv4", "ipv6"} {
+		b.WriteString(`aw_failovers_total{family="` + family + `"} ` + strconv.Itoa(m.failovers[family]) + "\n")
+	}
+	b.WriteString("# HELP aw_dns_api_errors_total Failed DNS provider API requests by provider.\n")
+	b.WriteString("# TYPE aw_dns_api_errors_total counter\n")
+	for _, provider := range []string{"cloudflare", "digitalocean"} {
+		b.WriteString(`aw_dns_api_errors_total{provider="` + provider + `"} ` + strconv.Itoa(m.apiErrors[provider]) + "\n")
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ICMP message types of the echo
+const (
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+)
+
+// pingSeq numbers echo requests, so concurrent checks match their own replies
+var pingSeq uint32
+
+// listenICMP opens the raw ICMP socket, it needs root or the cap_net_raw capability
+func listenICMP() (net.PacketConn, error) {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, errors.New("check=ping needs a raw socket, run as root or grant cap_net_raw: " + err.Error())
+	}
+	return conn, nil
+}
+
+// icmpChecksum returns the internet checksum of the message
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// echoRequest returns the ICMP echo request message of the identifier and the sequence number
+func echoRequest(id, seq uint16) []byte {
+	msg := []byte{icmpEchoRequest, 0, 0, 0, byte(id >> 8), byte(id), byte(seq >> 8), byte(seq), 'a', 'w'}
+	sum := icmpChecksum(msg)
+	msg[2], msg[3] = byte(sum>>8), byte(sum)
+	return msg
+}
+
+// checkPing sends an ICMP echo request to the node, the latency is the round trip time
+func (cfg *config) checkPing(ctx context.Context, ip string) checkResult {
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.To4() == nil {
+		// the ip is checked at startup
+		return checkResult{}
+	}
+	conn, err := listenICMP()
+	if err != nil {
+		return checkResult{}
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(cfg.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return checkResult{}
+	}
+	id := uint16(os.Getpid())
+	seq := uint16(atomic.AddUint32(&pingSeq, 1))
+	t0 := time.Now()
+	if _, err := conn.WriteTo(echoRequest(id, seq), &net.IPAddr{IP: addr}); err != nil {
+		return checkResult{}
+	}
+	buf := make([]byte, 1500)
+	for {
+		// the raw socket receives all ICMP messages of the host
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return checkResult{}
+		}
+		reply := buf[:n]
+		if len(reply) < 8 || reply[0] != icmpEchoReply || !isAddrEqual(from.(*net.IPAddr).IP.String(), ip) {
+			continue
+		}
+		if uint16(reply[4])<<8|uint16(reply[5]) == id && uint16(reply[6])<<8|uint16(reply[7]) == seq {
+			return checkResult{
+				ok:      true,
+				latency: time.Since(t0),
+			}
+		}
+	}
+}
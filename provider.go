@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errTooManyDeletes = errors.New("record deletion is locked, maxdelete exceeded")
+
+// Limit of records to delete in a watch cycle, so a bug does not delete the zone
+type deleteLimit struct {
+	max    int  // maximum number of records to delete in a watch cycle
+	count  int  // number of records deleted in the watch cycle
+	locked bool // the maximum was exceeded, deletion is locked until restart
+}
+
+// readDeleteLimit returns the limit of the maxdelete setting, 10 records by default
+func readDeleteLimit(ini iniFile) (deleteLimit, error) {
+	l := deleteLimit{max: 10}
+	if value := ini.Get("", "maxdelete"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return l, errors.New("maxdelete=" + value + " is not a number")
+		}
+		l.max = n
+	}
+	return l, nil
+}
+
+// allow counts records to delete in the watch cycle,
+// when the maximum is exceeded, nothing is deleted until restart
+func (l *deleteLimit) allow(n int) error {
+	if l.locked {
+		return errTooManyDeletes
+	}
+	if l.count+n > l.max {
+		l.locked = true
+		log.Println("CRITICAL: " + strconv.Itoa(l.count+n) + " records to delete exceeds maxdelete=" +
+			strconv.Itoa(l.max) + ", record deletion is locked until restart")
+		return errTooManyDeletes
+	}
+	l.count += n
+	return nil
+}
+
+// dnsProvider switches the domain records, the watch cycle decides where to.
+// The zone is loaded by every method, so an implementation keeps no zone state between cycles
+type dnsProvider interface {
+	// newCycle starts the watch cycle
+	newCycle()
+	// actualRecords returns the A and AAAA record contents of the domain, blank when there is no record
+	actualRecords(ctx context.Context) (string, string, error)
+	// moveRecords changes A records from sourceIP to targetIP, a planned switch may drain clients first.
+	// It returns the full names of the changed records
+	moveRecords(ctx context.Context, sourceIP, targetIP string, planned bool) ([]string, error)
+	// moveRecordsIPv6 changes AAAA records to targetIPv6, the records are deleted when targetIPv6 is blank
+	moveRecordsIPv6(ctx context.Context, sourceIPv6, targetIPv6 string) error
+	// isBlank reports whether no managed record exists
+	isBlank(ctx context.Context) (bool, error)
+	// bootstrapRecords creates A records and, when the IPv6 is not blank, AAAA records
+	bootstrapRecords(ctx context.Context, ip, ipv6 string) error
+	// flush applies pending changes of the watch cycle
+	flush(ctx context.Context) error
+	// pinnedContents returns record contents of the name, that are not failover targets
+	pinnedContents(name string) []string
+	// switchWait returns the extra time a switch may take, for example, to drain clients
+	switchWait() time.Duration
+	// reconcileRecords makes A records of the names point to exactly the targets, records are created first
+	reconcileRecords(ctx context.Context, targets []string) error
+	// writeText creates or changes the TXT record of the name to the content
+	writeText(ctx context.Context, name, content string) error
+	// describeRecords returns lines, that describe the managed records of the domain, for the debug log
+	describeRecords(ctx context.Context) ([]string, error)
+}
+
+// newProvider returns the DNS provider of the configuration, CloudFlare by default
+func newProvider(ini iniFile, domain string, names []string) (dnsProvider, error) {
+	switch name := strings.ToLower(ini.Get("", "provider")); name {
+	case "", "cloudflare":
+		return newCFConfig(ini, domain, names)
+	case "digitalocean":
+		return newDOConfig(ini, domain, names)
+	default:
+		return nil, errors.New("unknown provider " + name)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// splitURLs returns the health check targets of the comma separated list
+func splitURLs(value string) []string {
+	var urls []string
+	for _, rawURL := range strings.Split(value, ",") {
+		if rawURL = strings.TrimSpace(rawURL); rawURL != "" {
+			urls = append(urls, rawURL)
+		}
+	}
+	return urls
+}
+
+// quorumOf returns the number of passed checks, the node is up with, the majority by default
+func (cfg *config) quorumOf(urls int) int {
+	if cfg.quorum == 0 {
+		return urls/2 + 1
+	}
+	if cfg.quorum > urls {
+		return urls
+	}
+	return cfg.quorum
+}
+
+// checkQuorum checks all URLs from the node IP concurrently, the node is alive,
+// when at least the quorum of checks pass. The latency is the median of passed checks
+func (cfg *config) checkQuorum(ctx context.Context, ip string, urls []string) checkResult {
+	results := make([]checkResult, len(urls))
+	var wg sync.WaitGroup
+	for i, rawURL := range urls {
+		wg.Add(1)
+		go func(i int, rawURL string) {
+			defer wg.Done()
+			results[i] = cfg.checkHTTP(ctx, ip, rawURL)
+		}(i, rawURL)
+	}
+	wg.Wait()
+	var passed []checkResult
+	for _, res := range results {
+		if res.ok {
+			passed = append(passed, res)
+		}
+	}
+	if len(passed) < cfg.quorumOf(len(urls)) {
+		// the first failure tells the node status, like draining
+		for _, res := range results {
+			if !res.ok {
+				return res
+			}
+		}
+	}
+	latencies := make([]time.Duration, len(passed))
+	for i, res := range passed {
+		latencies[i] = res.latency
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	res := passed[0]
+	res.latency = latencies[len(latencies)/2]
+	return res
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+)
+
+// newResolver returns the resolver querying the address, for example 1.1.1.1:53, the port is 53 by default,
+// or the system resolver, when the address is blank
+func newResolver(address string) *net.Resolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		// the port is omitted
+		address = net.JoinHostPort(address, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// propagationPoll is the interval of propagation lookups
+const propagationPoll = 2 * time.Second
+
+// waitPropagation polls the resolver until the domain resolves to the switched record content,
+// the propagation time is logged
+func (cfg *config) waitPropagation(ctx context.Context, recordType, content string) {
+	if recordType == "A" && net.ParseIP(content) == nil {
+		// a CNAME target resolves to addresses of the host name
+		return
+	}
+	protocol := "IPv4"
+	if recordType == "AAAA" {
+		protocol = "IPv6"
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.propagationTimeout)
+	defer cancel()
+	started := time.Now()
+	pinned := cfg.dns.pinnedContents("@")
+	for {
+		ip, err := lookupProtocolDomain(ctx, cfg.propagationResolver, protocol, cfg.domain, pinned)
+		if err == nil && isAddrEqual(ip, content) {
+			log.Println(recordType + " record " + content + " propagated in " + time.Since(started).Round(time.Millisecond).String())
+			return
+		}
+		if err := sleep(ctx, propagationPoll); err != nil {
+			log.Println("WARNING: " + recordType + " record " + content + " is not propagated in " +
+				time.Since(started).Round(time.Second).String())
+			return
+		}
+	}
+}
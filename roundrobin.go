@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// watchRoundRobin checks nodes and reconciles the A records to targets of all healthy nodes.
+// A removed node is not added back during the cooldown, so a flapping node does not churn the records
+func (cfg *config) watchRoundRobin(ctx context.Context) error {
+	results := cfg.checkNodes(ctx, -1)
+	// the reconcile is not limited by the time the checks took
+	ctx, cancelSwitch := context.WithTimeout(ctx, cfg.switchTimeout())
+	defer cancelSwitch()
+	served := map[string]bool{}
+	var targets []string
+	var nodes []nodeStatus
+	logMessage := ""
+	for i := range cfg.nodes {
+		n := &cfg.nodes[i]
+		if results[i] == nil {
+			// the node in maintenance or the node, that is not resolved, is not checked
+			nodes = append(nodes, nodeStatus{Name: n.name, IP: n.target(), Skipped: true, Maintenance: n.maintenance != ""})
+			if logMessage != "" {
+				logMessage += ", "
+			}
+			if n.maintenance != "" {
+				logMessage += n.name + " (maintenance)"
+			} else {
+				logMessage += n.name + " skipped"
+			}
+			if target := n.target(); n.unresolved() && target != "" && cfg.served[target] && cfg.stateOf(n.name).up && !served[target] {
+				// the node state is unknown, the record of the virtual IP is kept
+				served[target] = true
+				targets = append(targets, target)
+			}
+			continue
+		}
+		res := *results[i]
+		metrics.setNode(n.name, res)
+		var up bool
+		if res.draining {
+			up, _ = cfg.drainState(n.name)
+		} else {
+			up, _ = cfg.updateState(n.name, res.ok)
+		}
+		nodes = append(nodes, nodeStatus{
+			Name:        n.name,
+			IP:          n.target(),
+			Up:          up,
+			Check:       res.ok,
+			LatencyMS:   res.latency.Milliseconds(),
+			Fails:       cfg.states[n.name].fails,
+			Draining:    res.draining,
+			Maintenance: n.maintenance != "",
+			Uptime:      cfg.nodeUptime(n.name),
+		})
+		if logMessage != "" {
+			logMessage += ", "
+		}
+		logMessage += n.name
+		switch {
+		case n.maintenance != "":
+			logMessage += " (maintenance)"
+		case res.draining:
+			// the draining node is alive, its record is removed without a failure
+			logMessage += " Draining " + strconv.Itoa(res.status)
+		case !res.ok || !up:
+			logMessage += " Fail"
+			if res.status != 0 {
+				logMessage += " " + strconv.Itoa(res.status)
+			}
+		case cfg.served != nil && !cfg.served[n.target()] && time.Since(cfg.removed[n.target()]) < cfg.cooldown:
+			logMessage += " " + strconv.Itoa(int(res.latency/time.Millisecond)) + "ms cooldown"
+		default:
+			logMessage += " " + strconv.Itoa(int(res.latency/time.Millisecond)) + "ms"
+			if !served[n.target()] {
+				served[n.target()] = true
+				targets = append(targets, n.target())
+			}
+		}
+	}
+	log.Println(logMessage)
+	if len(targets) == 0 {
+		// no record is better than a record of a failing node
+		err := errors.New("no node is healthy, round robin records are kept")
+		notify("error", "", err.Error())
+		cfg.publishStatus("", "", "", nil, nodes, err)
+		return err
+	}
+	err := cfg.dns.reconcileRecords(ctx, targets)
+	if flushErr := cfg.dns.flush(ctx); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		notify("error", "", err.Error())
+	} else {
+		if !sameKeys(served, cfg.served) {
+			notify("switch", "", "Round robin records point to "+strings.Join(targets, ", "))
+		}
+		for target := range cfg.served {
+			if !served[target] {
+				cfg.removed[target] = time.Now()
+			}
+		}
+		cfg.served = served
+	}
+	cfg.publishStatus("", strings.Join(targets, ","), "", nil, nodes, err)
+	return err
+}
+
+// sameKeys reports whether the sets are equal
+func sameKeys(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range a {
+		if !b[key] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package main
+
+import "time"
+
+// Healthy node to select from
+type candidate struct {
+	node       *node
+	result     checkResult
+	rank       time.Duration // response time scaled by weight, with the recovery penalty
+	recovering bool
+}
+
+// selector chooses the node to switch the A and AAAA records to.
+// Candidates are healthy nodes in the configuration order, the result is nil when there is no choice
+type selector interface {
+	selectNode(candidates []candidate) *node
+}
+
+// selectors by name, a custom selector may be compiled in by adding it here
+var selectors = map[string]selector{
+	"fastest": fastestSelector{},
+	"ordered": orderedSelector{},
+}
+
+// fastestSelector selects the node with the lowest priority number and the minimal rank, it is the default selector.
+// A recovering node is selected only when no settled node is healthy, whatever its priority
+type fastestSelector struct{}
+
+func (fastestSelector) selectNode(candidates []candidate) *node {
+	settled := false
+	for _, c := range candidates {
+		settled = settled || !c.recovering
+	}
+	var selected *candidate
+	for i := range candidates {
+		c := &candidates[i]
+		if settled && c.recovering {
+			continue
+		}
+		if selected == nil || c.node.priority < selected.node.priority ||
+			c.node.priority == selected.node.priority && c.rank < selected.rank {
+			selected = c
+		}
+	}
+	if selected == nil {
+		return nil
+	}
+	return selected.node
+}
+
+// orderedSelector selects the first settled node in the configuration order
+type orderedSelector struct{}
+
+func (orderedSelector) selectNode(candidates []candidate) *node {
+	for _, c := range candidates {
+		if !c.recovering {
+			return c.node
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	// all nodes are recovering
+	return candidates[0].node
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// Node state of the state file
+type savedNode struct {
+	Up    bool `json:"up"`
+	Fails int  `json:"fails"`
+	Rises int  `json:"rises"`
+}
+
+// Switched record of the state file
+type savedSwitch struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
+
+// State file content, that survives a restart
+type savedState struct {
+	Nodes        map[string]savedNode `json:"nodes"`
+	LastFailover time.Time            `json:"last_failover,omitempty"`
+	SwitchedIP   *savedSwitch         `json:"switched_ip,omitempty"`
+	SwitchedIPv6 *savedSwitch         `json:"switched_ipv6,omitempty"`
+	ActiveGroup  string               `json:"active_group,omitempty"`
+}
+
+// saveSwitch returns the switched record while it is settling
+func saveSwitch(s switched) *savedSwitch {
+	if s.ip == "" || time.Now().After(s.until) {
+		return nil
+	}
+	return &savedSwitch{IP: s.ip, Until: s.until}
+}
+
+// restoreSwitch returns the switched record of the state file
+func restoreSwitch(s *savedSwitch) switched {
+	if s == nil {
+		return switched{}
+	}
+	return switched{ip: s.IP, until: s.Until}
+}
+
+// loadState restores node states of the state file, a missing or corrupt file is a fresh start
+func (cfg *config) loadState() {
+	if cfg.stateFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(cfg.stateFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Println("WARNING: state file " + cfg.stateFile + ": " + err.Error() + ", starting fresh")
+		return
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Println("WARNING: state file " + cfg.stateFile + " is corrupt, starting fresh")
+		return
+	}
+	for _, n := range cfg.nodes {
+		// states of nodes removed from the config are dropped
+		if saved, ok := state.Nodes[n.name]; ok {
+			cfg.states[n.name] = &nodeState{
+				checked: true,
+				up:      saved.Up,
+				fails:   saved.Fails,
+				rises:   saved.Rises,
+			}
+		}
+	}
+	cfg.lastFailover = state.LastFailover
+	cfg.switchedIP = restoreSwitch(state.SwitchedIP)
+	cfg.switchedIPv6 = restoreSwitch(state.SwitchedIPv6)
+	cfg.activeGroup = state.ActiveGroup
+}
+
+// saveState writes node states to the state file
+func (cfg *config) saveState() {
+	if cfg.stateFile == "" {
+		return
+	}
+	state := savedState{
+		Nodes:        map[string]savedNode{},
+		LastFailover: cfg.lastFailover,
+		SwitchedIP:   saveSwitch(cfg.switchedIP),
+		SwitchedIPv6: saveSwitch(cfg.switchedIPv6),
+		ActiveGroup:  cfg.activeGroup,
+	}
+	for name, s := range cfg.states {
+		if s.checked {
+			state.Nodes[name] = savedNode{Up: s.up, Fails: s.fails, Rises: s.rises}
+		}
+	}
+	data, err := json.Marshal(&state)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// write a temporary file and rename it, so a crash never leaves a partial file
+	tmp := cfg.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Println(err)
+		return
+	}
+	if err := os.Rename(tmp, cfg.stateFile); err != nil {
+		log.Println(err)
+	}
+}
+
+// inherit takes node states of the running config, so a reload keeps counters and settling records
+func (cfg *config) inherit(running *config) {
+	for _, n := range cfg.nodes {
+		// states of removed nodes are dropped
+		if s, ok := running.states[n.name]; ok {
+			cfg.states[n.name] = s
+		}
+	}
+	cfg.lastFailover = running.lastFailover
+	cfg.switchedIP = running.switchedIP
+	cfg.switchedIPv6 = running.switchedIPv6
+	cfg.activeGroup = running.activeGroup
+	cfg.mailed = running.mailed
+	if cfg.active == running.active {
+		cfg.acting = running.acting
+	}
+}
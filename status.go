@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Node state of the status snapshot
+type nodeStatus struct {
+	Name      string `json:"name"`
+	IP        string `json:"ip"`
+	Up        bool   `json:"up"`
+	Check     bool   `json:"check"` // last check result, the node state changes after consecutive results
+	LatencyMS int64  `json:"latency_ms"`
+	Fails     int    `json:"fails"`
+	Skipped   bool   `json:"skipped,omitempty"` // not checked by early decision
+	// node is in maintenance, it is never selected
+	Maintenance bool `json:"maintenance,omitempty"`
+	// node is alive, but sheds new traffic, it is not selected
+	Draining bool `json:"draining,omitempty"`
+	// passed checks of the last historysize cycles, percent
+	Uptime *float64 `json:"uptime_percent,omitempty"`
+}
+
+// State of the last completed watch cycle
+type statusSnapshot struct {
+	Time         time.Time    `json:"time"`
+	Domain       string       `json:"domain"`
+	Active       string       `json:"active"` // node name, blank for an unknown IP
+	IP           string       `json:"ip"`
+	IPv6         string       `json:"ipv6,omitempty"`
+	LastFailover *time.Time   `json:"last_failover,omitempty"`
+	Nodes        []nodeStatus `json:"nodes"`
+	Error        string       `json:"error,omitempty"`
+}
+
+// Status endpoint, that serves the last snapshot of each domain
+type statusHandler struct {
+	mu   sync.Mutex
+	last map[string]*statusSnapshot // by domain
+}
+
+var status = &statusHandler{}
+
+// publish replaces the snapshot of the domain
+func (h *statusHandler) publish(s *statusSnapshot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.last == nil {
+		h.last = map[string]*statusSnapshot{}
+	}
+	h.last[s.Domain] = s
+}
+
+// ServeHTTP writes the last snapshot as JSON, the status is 503 before the first cycle is completed.
+// Snapshots of several domains are written as an array, sorted by domain
+func (h *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	snapshots := make([]*statusSnapshot, 0, len(h.last))
+	for _, s := range h.last {
+		snapshots = append(snapshots, s)
+	}
+	h.mu.Unlock()
+	if len(snapshots) == 0 {
+		http.Error(w, "no watch cycle completed yet", http.StatusServiceUnavailable)
+		return
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Domain < snapshots[j].Domain })
+	var last interface{} = snapshots
+	if len(snapshots) == 1 {
+		last = snapshots[0]
+	}
+	data, err := json.MarshalIndent(last, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, '\n'))
+}
+
+// publishStatus saves the state of the completed watch cycle, the records are switched to moved contents
+func (cfg *config) publishStatus(active, actualIP, actualIPv6 string, moved map[string]string, nodes []nodeStatus, err error) {
+	s := &statusSnapshot{
+		Time:   time.Now(),
+		Domain: cfg.domain,
+		Active: active,
+		IP:     actualIP,
+		IPv6:   actualIPv6,
+		Nodes:  nodes,
+	}
+	if ip, ok := moved["A"]; ok {
+		s.IP = ip
+	}
+	if ipv6, ok := moved["AAAA"]; ok {
+		s.IPv6 = ipv6
+	}
+	if !cfg.lastFailover.IsZero() {
+		lastFailover := cfg.lastFailover
+		s.LastFailover = &lastFailover
+	}
+	if err != nil {
+		s.Error = logOutput.redact(err.Error())
+	}
+	status.publish(s)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseEscaped converts Go escape sequences like \r\n of the ini value
+func parseEscaped(value string) []byte {
+	s, err := strconv.Unquote(`"` + value + `"`)
+	if err != nil {
+		return []byte(value)
+	}
+	return []byte(s)
+}
+
+// checkTCP connects to the node port, the latency is the connect time
+func (cfg *config) checkTCP(ctx context.Context, ip string) checkResult {
+	return cfg.checkConnect(ctx, ip, cfg.checkPort)
+}
+
+// checkConnect connects to the port of the IP, the latency is the connect time
+func (cfg *config) checkConnect(ctx context.Context, ip string, port string) checkResult {
+	t0 := time.Now()
+	dialer := &net.Dialer{Timeout: cfg.dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, port))
+	if err != nil {
+		return checkResult{}
+	}
+	conn.Close()
+	return checkResult{
+		ok:      true,
+		latency: time.Since(t0),
+	}
+}
+
+// checkTCPExpect sends the request bytes to the node and matches the response prefix,
+// the latency is the time to the expected response
+func (cfg *config) checkTCPExpect(ctx context.Context, ip string) checkResult {
+	t0 := time.Now()
+	dialer := &net.Dialer{Timeout: cfg.dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, cfg.checkPort))
+	if err != nil {
+		return checkResult{}
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(t0.Add(cfg.timeout)); err != nil {
+		return checkResult{}
+	}
+	if _, err := conn.Write(cfg.checkSend); err != nil {
+		return checkResult{}
+	}
+	response := make([]byte, len(cfg.checkExpect))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return checkResult{}
+	}
+	if !bytes.Equal(response, cfg.checkExpect) {
+		return checkResult{}
+	}
+	return checkResult{
+		ok:      true,
+		latency: time.Since(t0),
+	}
+}
+
+// checkSRV resolves the SRV record of the node and checks the target of the highest priority by srvcheck:
+// the HTTP check gets the URL from the target IP and port, the tcp check connects to the target port
+func (cfg *config) checkSRV(ctx context.Context, name string, rawURL string) checkResult {
+	// the targets are sorted by priority and randomized by weight
+	_, targets, err := cfg.resolver.LookupSRV(ctx, "", "", name)
+	if err != nil || len(targets) == 0 {
+		return checkResult{}
+	}
+	ip := strings.TrimSuffix(targets[0].Target, ".")
+	port := strconv.Itoa(int(targets[0].Port))
+	if net.ParseIP(ip) == nil {
+		if ip, err = lookupDomain(ctx, cfg.resolver, ip); err != nil {
+			return checkResult{}
+		}
+	}
+	if cfg.srvCheck == "tcp" {
+		return cfg.checkConnect(ctx, ip, port)
+	}
+	urls := splitURLs(rawURL)
+	for i := range urls {
+		urls[i] = srvURL(urls[i], port)
+	}
+	switch len(urls) {
+	case 0:
+		// the url is checked at startup
+		return checkResult{}
+	case 1:
+		return cfg.checkHTTP(ctx, ip, urls[0])
+	}
+	return cfg.checkQuorum(ctx, ip, urls)
+}
+
+// srvURL returns the URL with the port of the SRV target, the URL host name is kept for the TLS handshake
+func srvURL(rawURL string, port string) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		// the bad URL is logged by the check
+		return rawURL
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), port)
+	return u.String()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// serveDNS answers DNS queries of the UDP connection, the SRV record of any name is the node.test target
+// and the port, the A record of any name is 127.0.0.1
+func serveDNS(t *testing.T, port uint16) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// the question ends with the blank label, the type and the class
+			end := 12
+			for end < n && buf[end] != 0 {
+				end += int(buf[end]) + 1
+			}
+			end += 5
+			if end > n {
+				continue
+			}
+			resp := append([]byte{}, buf[:end]...)
+			// response, recursion desired and available
+			binary.BigEndian.PutUint16(resp[2:], 0x8180)
+			binary.BigEndian.PutUint16(resp[8:], 0)
+			binary.BigEndian.PutUint16(resp[10:], 0)
+			// the answer name points to the question, IN class, TTL 60
+			switch binary.BigEndian.Uint16(resp[end-4:]) {
+			case 1:
+				binary.BigEndian.PutUint16(resp[6:], 1)
+				resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+			case 33:
+				binary.BigEndian.PutUint16(resp[6:], 1)
+				target := []byte{4, 'n', 'o', 'd', 'e', 4, 't', 'e', 's', 't', 0}
+				resp = append(resp, 0xc0, 12, 0, 33, 0, 1, 0, 0, 0, 60)
+				resp = binary.BigEndian.AppendUint16(resp, uint16(6+len(target)))
+				// priority and weight
+				resp = append(resp, 0, 0, 0, 0)
+				resp = binary.BigEndian.AppendUint16(resp, port)
+				resp = append(resp, target...)
+			default:
+				binary.BigEndian.PutUint16(resp[6:], 0)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestCheckSRV(t *testing.T) {
+	node := newFakeNode(t, 0)
+	port, err := strconv.Atoi(node.port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.checkURL = ""
+	node.settings = "srv = _http._tcp.node1.example.com\n"
+	for _, srvCheck := range []string{"http", "tcp"} {
+		// the watch URL port is replaced by the SRV port
+		cfg, _ := newTestConfig(t, "url = http://www.example.com:1/ready\ncheck = srv\nsrvcheck = "+srvCheck+
+			"\nresolver = "+serveDNS(t, uint16(port))+"\n", node)
+		node.path.Store("")
+		res := cfg.checkShared(context.Background(), &cfg.nodes[0])
+		if !res.ok {
+			t.Fatalf("srvcheck=%s: the SRV target fails the check", srvCheck)
+		}
+		path, _ := node.path.Load().(string)
+		if srvCheck == "http" && (res.status != http.StatusOK || path != "/ready") {
+			t.Errorf("srvcheck=http: status is %d, checked path is %s, want 200 and /ready", res.status, path)
+		}
+		if srvCheck == "tcp" && path != "" {
+			t.Errorf("srvcheck=tcp: the HTTP check is made, path %s", path)
+		}
+	}
+	node.setStatus(http.StatusInternalServerError)
+	cfg, _ := newTestConfig(t, "url = http://www.example.com/\ncheck = srv\nresolver = "+serveDNS(t, uint16(port))+"\n", node)
+	if res := cfg.checkShared(context.Background(), &cfg.nodes[0]); res.ok || res.status != http.StatusInternalServerError {
+		t.Errorf("check result is %+v, want the failed status of the URL", res)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record switch, posted to the webhook
+type switchEvent struct {
+	Time   time.Time `json:"timestamp"`
+	Domain string    `json:"domain"`
+	Type   string    `json:"type"`
+	From   string    `json:"old_ip"`
+	To     string    `json:"new_ip"`
+	Names  []string  `json:"names,omitempty"` // full names of the changed records
+	Reason string    `json:"reason"`
+	Error  string    `json:"error,omitempty"`
+	Text   string    `json:"text"` // summary for Slack incoming webhooks
+}
+
+// webhookTimeout limits the webhook post, so a slow receiver does not delay the watch cycle
+const webhookTimeout = 5 * time.Second
+
+// Record switch result of the watch cycle
+type switchReport struct {
+	recordType string
+	from       string
+	to         string
+	reason     string
+	names      []string // full names of the changed records
+	err        error
+}
+
+// reportSwitch counts, logs, mails and posts the record switch result.
+// A dry run switch is logged only, so no record seems switched
+func (cfg *config) reportSwitch(r switchReport) {
+	e := switchEvent{
+		Time:   time.Now(),
+		Domain: cfg.domain,
+		Type:   r.recordType,
+		From:   r.from,
+		To:     r.to,
+		Names:  r.names,
+		Reason: r.reason,
+	}
+	e.Text = cfg.domain + " " + r.recordType + " " + r.from + " -> " + r.to + ": " + r.reason
+	if len(r.names) > 0 {
+		e.Text += ", changed " + strings.Join(r.names, ", ")
+	}
+	if r.err != nil {
+		e.Error = r.err.Error()
+		e.Text += ", failed: " + e.Error
+	}
+	if cfg.dryRun {
+		log.Println("Dry run: " + logOutput.redact(e.Text))
+		return
+	}
+	if r.err == nil {
+		family := "ipv4"
+		if r.recordType == "AAAA" {
+			family = "ipv6"
+		}
+		metrics.failover(family)
+		cfg.lastFailover = e.Time
+		if r.recordType == "A" {
+			cfg.breaker.record()
+		}
+		logFailover(r.recordType, r.from, r.to)
+	}
+	subject := "aw: " + cfg.domain + " " + r.recordType + " switched to " + r.to
+	if r.err != nil {
+		subject = "aw: " + cfg.domain + " " + r.recordType + " switch to " + r.to + " failed"
+	}
+	if outcome := r.to + " " + strconv.FormatBool(r.err == nil); cfg.mailed[r.recordType] != outcome {
+		// only a change of the outcome is mailed
+		cfg.mailed[r.recordType] = outcome
+		cfg.mail.send(subject, logOutput.redact(e.Text))
+	}
+	if cfg.webhook != "" {
+		cfg.postWebhook(&e)
+	}
+}
+
+// reportRecovery posts the node recovery, the event type is "recovery"
+func (cfg *config) reportRecovery(name string) {
+	if cfg.webhook == "" {
+		return
+	}
+	e := switchEvent{
+		Time:   time.Now(),
+		Domain: cfg.domain,
+		Type:   "recovery",
+		Reason: name + " is up",
+	}
+	e.Text = cfg.domain + " node " + name + " is up"
+	cfg.postWebhook(&e)
+}
+
+// postWebhook posts the event as JSON, a failure is logged only
+func (cfg *config) postWebhook(e *switchEvent) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Println("WARNING: webhook: " + err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", cfg.webhook, bytes.NewReader(data))
+	if err != nil {
+		log.Println("WARNING: webhook: " + err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Println("WARNING: webhook: " + err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Println("WARNING: webhook: " + resp.Status)
+	}
+}